@@ -29,6 +29,7 @@ export declare abstract class ControlyBase<EventMap extends Record<string, (...a
     protected ws: WebSocket | null;
     protected emitter: EventEmitter<EventMap>;
     protected clientId: string | null;
+    private resumeToken;
     private readonly reconnect;
     private readonly maxRetries;
     private readonly reconnectDelay;
@@ -56,6 +57,12 @@ export declare abstract class ControlyBase<EventMap extends Record<string, (...a
      * @throws {Error} if the connection is already open or in the process of connecting.
      */
     connect(): void;
+    /**
+     * Returns the URL to connect to. Once the server has assigned an ID, the
+     * client reconnects with it and its resume token to resume its session.
+     * @private
+     */
+    private connectUrl;
     /**
      * Disconnects from the Controly server.
      */
@@ -85,6 +92,13 @@ export declare abstract class ControlyBase<EventMap extends Record<string, (...a
      * @returns The client ID, or null if not yet assigned.
      */
     getId(): string | null;
+    /**
+     * Gets the token that resumes the current session. Pass it as the
+     * `resumeToken` option, with the same `id`, to resume the session from
+     * another page load.
+     * @returns The resume token, or null if not yet assigned.
+     */
+    getResumeToken(): string | null;
     /**
      * Logs a message to the console if not in silent mode.
      * @param {...any[]} args - The arguments to log.
@@ -46,6 +46,7 @@ export class ControlyBase {
         this.ws = null;
         this.emitter = new EventEmitter();
         this.clientId = null;
+        this.resumeToken = null;
         this.reconnectAttempts = 0;
         this.explicitDisconnect = false;
         this.handleOpen = () => {
@@ -56,9 +57,10 @@ export class ControlyBase {
             try {
                 const message = JSON.parse(event.data);
                 if (message.type === 'set_id') {
-                    const { id } = message.payload;
+                    const { id, resume_token, resumed } = message.payload;
                     this.clientId = id;
-                    this.emitter.emit('open', this.clientId);
+                    this.resumeToken = resume_token ?? null;
+                    this.emitter.emit('open', this.clientId, resumed ?? false);
                     return;
                 }
                 if (message.type === 'error') {
@@ -116,6 +118,7 @@ export class ControlyBase {
         this.maxRetries = options.maxRetries ?? 5;
         this.reconnectDelay = options.reconnectDelay ?? 10 * 1000;
         this.silent = options.silent ?? false;
+        this.resumeToken = options.resumeToken ?? null;
     }
     /**
      * Registers an event listener for a specific event.
@@ -137,12 +140,27 @@ export class ControlyBase {
         this.cleanup();
         this.explicitDisconnect = false;
         // Do not reset reconnectAttempts here, allow handleClose to manage it.
-        this.ws = new WebSocket(this.fullUrl);
+        this.ws = new WebSocket(this.connectUrl());
         this.ws.addEventListener('open', this.handleOpen);
         this.ws.addEventListener('message', this.handleMessage);
         this.ws.addEventListener('error', this.handleError);
         this.ws.addEventListener('close', this.handleClose);
     }
+    /**
+     * Returns the URL to connect to. Once the server has assigned an ID, the
+     * client reconnects with it and its resume token to resume its session.
+     * @private
+     */
+    connectUrl() {
+        const url = new URL(this.fullUrl);
+        if (this.clientId) {
+            url.searchParams.set('id', this.clientId);
+        }
+        if (this.resumeToken) {
+            url.searchParams.set('resume_token', this.resumeToken);
+        }
+        return url.toString();
+    }
     /**
      * Disconnects from the Controly server.
      */
@@ -184,6 +202,15 @@ export class ControlyBase {
     getId() {
         return this.clientId;
     }
+    /**
+     * Gets the token that resumes the current session. Pass it as the
+     * `resumeToken` option, with the same `id`, to resume the session from
+     * another page load.
+     * @returns The resume token, or null if not yet assigned.
+     */
+    getResumeToken() {
+        return this.resumeToken;
+    }
     /**
      * Logs a message to the console if not in silent mode.
      * @param {...any[]} args - The arguments to log.
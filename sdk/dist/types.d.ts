@@ -4,7 +4,7 @@
 /**
  * Represents the type of a WebSocket message.
  */
-export type MessageType = 'set_id' | 'command_list' | 'command' | 'status' | 'subscribe' | 'unsubscribe' | 'notification' | 'error' | 'subscribed' | 'unsubscribed' | 'waiting';
+export type MessageType = 'set_id' | 'command_list' | 'command' | 'command_result' | 'status' | 'status_patch' | 'subscribe' | 'unsubscribe' | 'notification' | 'error' | 'subscribed' | 'unsubscribed' | 'waiting';
 /**
  * Base interface for all WebSocket messages.
  */
@@ -17,18 +17,35 @@ export interface BaseMessage<T extends MessageType, P> {
  */
 export interface IncomingMessage<T extends MessageType, P> extends BaseMessage<T, P> {
     to?: string;
+    /**
+     * Correlation ID of a `command` that expects a `command_result`, or of the
+     * command a `command_result` answers.
+     */
+    id?: string;
 }
 /**
  * Interface for messages received from the server.
  */
 export interface OutgoingMessage<T extends MessageType, P> extends BaseMessage<T, P> {
     from?: string;
+    /**
+     * Correlation ID of a forwarded `command` or `command_result`.
+     */
+    id?: string;
 }
 /**
  * Payload for the `set_id` message from the server.
  */
 export interface SetIdPayload {
     id: string;
+    /**
+     * Token to send as `resume_token` when reconnecting, to resume the session.
+     */
+    resume_token?: string;
+    /**
+     * Whether an existing session was resumed.
+     */
+    resumed?: boolean;
 }
 /**
  * Payload for the `subscribe` message sent by a Controller.
@@ -49,10 +66,36 @@ export interface CommandPayload {
     name: string;
     args?: Record<string, any>;
 }
+/**
+ * Status of a `command_result`. Displays answer with `success` or `error`;
+ * the server reports `timeout` when a display does not answer in time.
+ */
+export type CommandResultStatus = 'success' | 'error' | 'timeout';
+/**
+ * Payload for a `command_result` message, answering a `command` sent with an `id`.
+ */
+export interface CommandResultPayload {
+    status: CommandResultStatus;
+    /**
+     * Optional return value of the command.
+     */
+    result?: any;
+    /**
+     * Error description when the status is not `success`.
+     */
+    error?: string;
+}
 /**
  * A generic payload for `status` messages sent by a Display.
  */
 export type StatusPayload = Record<string, any>;
+/**
+ * Payload for `status_patch` messages: a JSON Merge Patch (RFC 7396) of the
+ * latest status, where `null` removes a field. Only controllers that connect
+ * with `status_mode=patch` receive them; the SDK connects in `full` mode and
+ * receives merged `status` messages instead.
+ */
+export type StatusPatchPayload = Record<string, any>;
 /**
  * A generic payload for `notification` messages sent by the server.
  */
@@ -132,9 +175,10 @@ export type CommandListPayload = Command[];
  */
 export type ControlyEventHandler<T> = (payload: T, from?: string) => void;
 /**
- * Handler for the 'open' event, receiving the client's assigned ID.
+ * Handler for the 'open' event, receiving the client's assigned ID and whether
+ * an existing session was resumed.
  */
-export type OpenHandler = (id: string) => void;
+export type OpenHandler = (id: string, resumed: boolean) => void;
 /**
  * Handler for the 'close' event.
  */
@@ -218,6 +262,12 @@ export interface ControlyOptions {
      * An optional client ID to resume a previous session.
      */
     id?: string;
+    /**
+     * The resume token of a previous session with the same `id`, as returned by
+     * `getResumeToken()`. Reconnections after a dropped connection send it
+     * automatically.
+     */
+    resumeToken?: string;
     /**
      * For Displays, the URL to the `command.json` file.
      * @example 'http://localhost:3000/command.json'
@@ -44,6 +44,7 @@ export abstract class ControlyBase<EventMap extends Record<string, (...args: any
 	protected ws: WebSocket | null = null
 	protected emitter: EventEmitter<EventMap> = new EventEmitter<EventMap>()
 	protected clientId: string | null = null
+	private resumeToken: string | null = null
 
 	private readonly reconnect: boolean
 	private readonly maxRetries: number
@@ -75,6 +76,7 @@ export abstract class ControlyBase<EventMap extends Record<string, (...args: any
 		this.maxRetries = options.maxRetries ?? 5
 		this.reconnectDelay = options.reconnectDelay ?? 10 * 1000
 		this.silent = options.silent ?? false
+		this.resumeToken = options.resumeToken ?? null
 	}
 
 	/**
@@ -100,13 +102,29 @@ export abstract class ControlyBase<EventMap extends Record<string, (...args: any
 
 		this.explicitDisconnect = false
 		// Do not reset reconnectAttempts here, allow handleClose to manage it.
-		this.ws = new WebSocket(this.fullUrl)
+		this.ws = new WebSocket(this.connectUrl())
 		this.ws.addEventListener('open', this.handleOpen)
 		this.ws.addEventListener('message', this.handleMessage)
 		this.ws.addEventListener('error', this.handleError)
 		this.ws.addEventListener('close', this.handleClose)
 	}
 
+	/**
+	 * Returns the URL to connect to. Once the server has assigned an ID, the
+	 * client reconnects with it and its resume token to resume its session.
+	 * @private
+	 */
+	private connectUrl(): string {
+		const url = new URL(this.fullUrl)
+		if (this.clientId) {
+			url.searchParams.set('id', this.clientId)
+		}
+		if (this.resumeToken) {
+			url.searchParams.set('resume_token', this.resumeToken)
+		}
+		return url.toString()
+	}
+
 	/**
 	 * Disconnects from the Controly server.
 	 */
@@ -154,9 +172,10 @@ export abstract class ControlyBase<EventMap extends Record<string, (...args: any
 			const message = JSON.parse(event.data) as OutgoingMessage<any, any>
 
 			if (message.type === 'set_id') {
-				const { id } = message.payload as SetIdPayload
+				const { id, resume_token, resumed } = message.payload as SetIdPayload
 				this.clientId = id
-				this.emitter.emit('open', this.clientId)
+				this.resumeToken = resume_token ?? null
+				this.emitter.emit('open', this.clientId, resumed ?? false)
 				return
 			}
 
@@ -226,6 +245,16 @@ export abstract class ControlyBase<EventMap extends Record<string, (...args: any
 		return this.clientId
 	}
 
+	/**
+	 * Gets the token that resumes the current session. Pass it as the
+	 * `resumeToken` option, with the same `id`, to resume the session from
+	 * another page load.
+	 * @returns The resume token, or null if not yet assigned.
+	 */
+	public getResumeToken(): string | null {
+		return this.resumeToken
+	}
+
 	/**
 	 * Logs a message to the console if not in silent mode.
 	 * @param {...any[]} args - The arguments to log.
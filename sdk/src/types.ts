@@ -9,7 +9,9 @@ export type MessageType =
 	| 'set_id'
 	| 'command_list'
 	| 'command'
+	| 'command_result'
 	| 'status'
+	| 'status_patch'
 	| 'subscribe'
 	| 'unsubscribe'
 	| 'notification'
@@ -31,6 +33,11 @@ export interface BaseMessage<T extends MessageType, P> {
  */
 export interface IncomingMessage<T extends MessageType, P> extends BaseMessage<T, P> {
 	to?: string
+	/**
+	 * Correlation ID of a `command` that expects a `command_result`, or of the
+	 * command a `command_result` answers.
+	 */
+	id?: string
 }
 
 /**
@@ -38,6 +45,10 @@ export interface IncomingMessage<T extends MessageType, P> extends BaseMessage<T
  */
 export interface OutgoingMessage<T extends MessageType, P> extends BaseMessage<T, P> {
 	from?: string
+	/**
+	 * Correlation ID of a forwarded `command` or `command_result`.
+	 */
+	id?: string
 }
 
 // --- Payload Definitions ---
@@ -47,6 +58,14 @@ export interface OutgoingMessage<T extends MessageType, P> extends BaseMessage<T
  */
 export interface SetIdPayload {
 	id: string
+	/**
+	 * Token to send as `resume_token` when reconnecting, to resume the session.
+	 */
+	resume_token?: string
+	/**
+	 * Whether an existing session was resumed.
+	 */
+	resumed?: boolean
 }
 
 /**
@@ -71,11 +90,40 @@ export interface CommandPayload {
 	args?: Record<string, any>
 }
 
+/**
+ * Status of a `command_result`. Displays answer with `success` or `error`;
+ * the server reports `timeout` when a display does not answer in time.
+ */
+export type CommandResultStatus = 'success' | 'error' | 'timeout'
+
+/**
+ * Payload for a `command_result` message, answering a `command` sent with an `id`.
+ */
+export interface CommandResultPayload {
+	status: CommandResultStatus
+	/**
+	 * Optional return value of the command.
+	 */
+	result?: any
+	/**
+	 * Error description when the status is not `success`.
+	 */
+	error?: string
+}
+
 /**
  * A generic payload for `status` messages sent by a Display.
  */
 export type StatusPayload = Record<string, any>
 
+/**
+ * Payload for `status_patch` messages: a JSON Merge Patch (RFC 7396) of the
+ * latest status, where `null` removes a field. Only controllers that connect
+ * with `status_mode=patch` receive them; the SDK connects in `full` mode and
+ * receives merged `status` messages instead.
+ */
+export type StatusPatchPayload = Record<string, any>
+
 /**
  * A generic payload for `notification` messages sent by the server.
  */
@@ -170,9 +218,10 @@ export type CommandListPayload = Command[]
 export type ControlyEventHandler<T> = (payload: T, from?: string) => void
 
 /**
- * Handler for the 'open' event, receiving the client's assigned ID.
+ * Handler for the 'open' event, receiving the client's assigned ID and whether
+ * an existing session was resumed.
  */
-export type OpenHandler = (id: string) => void
+export type OpenHandler = (id: string, resumed: boolean) => void
 
 /**
  * Handler for the 'close' event.
@@ -275,6 +324,13 @@ export interface ControlyOptions {
 	 */
 	id?: string
 
+	/**
+	 * The resume token of a previous session with the same `id`, as returned by
+	 * `getResumeToken()`. Reconnections after a dropped connection send it
+	 * automatically.
+	 */
+	resumeToken?: string
+
 	/**
 	 * For Displays, the URL to the `command.json` file.
 	 * @example 'http://localhost:3000/command.json'
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// listenFDEnv tells a restarted process which file descriptors hold the
+// listening sockets inherited from its parent, as a comma-separated list.
+const listenFDEnv = "CONTROLY_LISTEN_FD"
+
+// listen returns a listening socket for each of addrs, inherited from a parent
+// process in the same order or newly opened. It reports whether the sockets
+// were inherited.
+func listen(addrs ...string) ([]net.Listener, bool, error) {
+	var fds []string
+	if fdStr := os.Getenv(listenFDEnv); fdStr != "" {
+		fds = strings.Split(fdStr, ",")
+		os.Unsetenv(listenFDEnv)
+	}
+	lns := make([]net.Listener, 0, len(addrs))
+	for i, addr := range addrs {
+		var ln net.Listener
+		var err error
+		if i < len(fds) {
+			ln, err = inherit(fds[i])
+		} else {
+			// The parent did not have this listener, e.g. because the
+			// configuration changed.
+			ln, err = net.Listen("tcp", addr)
+		}
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, false, err
+		}
+		lns = append(lns, ln)
+	}
+	return lns, len(fds) > 0, nil
+}
+
+func inherit(fdStr string) (net.Listener, error) {
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q", listenFDEnv, fdStr)
+	}
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherit listener: %w", err)
+	}
+	return ln, nil
+}
+
+// startChild starts a new instance of the running binary that takes over lns.
+// The new process keeps accepting connections while this one drains its own.
+// Under a process supervisor the child must not depend on this process staying
+// alive, e.g. as PID 1 in a container.
+func startChild(lns ...net.Listener) (*os.Process, error) {
+	files := make([]*os.File, 0, len(lns))
+	fds := make([]string, 0, len(lns))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, ln := range lns {
+		tcpLn, ok := ln.(*net.TCPListener)
+		if !ok {
+			return nil, fmt.Errorf("cannot hand off a %T", ln)
+		}
+		f, err := tcpLn.File()
+		if err != nil {
+			return nil, err
+		}
+		// ExtraFiles[i] becomes file descriptor 3+i in the child.
+		fds = append(fds, strconv.Itoa(3+len(files)))
+		files = append(files, f)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), listenFDEnv+"="+strings.Join(fds, ","))
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cmd.Process, nil
+}
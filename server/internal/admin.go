@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+type adminContextKey struct{}
+
+// AdminAuth returns a middleware that only lets requests carrying one of keys
+// through. A key is passed as a bearer token, in the X-API-Key header or, for
+// browsers opening the inspector, as a controly.token subprotocol.
+func AdminAuth(keys []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !validAdminKey(adminKey(r), keys) {
+				hotLog.Log(slog.Default(), slog.LevelWarn, "admin_auth", "Rejected admin request without a valid API key",
+					"remote_addr", r.RemoteAddr, "path", r.URL.Path)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="controly admin"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminContextKey{}, true)))
+		})
+	}
+}
+
+// adminKey returns the API key a request carries, if any.
+func adminKey(r *http.Request) string {
+	if key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return key
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	for _, protocol := range websocket.Subprotocols(r) {
+		if key, ok := strings.CutPrefix(protocol, tokenSubprotocol); ok {
+			return key
+		}
+	}
+	return ""
+}
+
+// validAdminKey compares key against every configured key in constant time.
+func validAdminKey(key string, keys []string) bool {
+	if key == "" {
+		return false
+	}
+	valid := 0
+	for _, k := range keys {
+		valid |= subtle.ConstantTimeCompare([]byte(key), []byte(k))
+	}
+	return valid == 1
+}
+
+// isAdmin reports whether a request was authenticated with an admin API key.
+func isAdmin(r *http.Request) bool {
+	admin, _ := r.Context().Value(adminContextKey{}).(bool)
+	return admin
+}
@@ -0,0 +1,250 @@
+package internal
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/simbafs/controly/server/internal/codec"
+	"github.com/simbafs/controly/server/internal/domain"
+	"github.com/simbafs/controly/server/internal/jwtauth"
+)
+
+// Client certificates name the role of their holder in an Organizational Unit
+// of their subject. Display certificates also name the display IDs they may
+// register as their Common Name and DNS SANs.
+const (
+	certRoleDisplay    = "display"
+	certRoleController = "controller"
+)
+
+// UseJWT makes every client authenticate with a token verified by v, unless
+// it presents a client certificate. Displays may still use the server token.
+func (h *Hub) UseJWT(v *jwtauth.Verifier) {
+	h.jwt = v
+}
+
+// clientCert returns the verified client certificate of a request, if any.
+func clientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// certDisplayIDs returns the display IDs a certificate may register.
+func certDisplayIDs(cert *x509.Certificate) []string {
+	var ids []string
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	return append(ids, cert.DNSNames...)
+}
+
+// tokenSubprotocol prefixes a token offered as a WebSocket subprotocol, for
+// browsers that cannot set the Authorization header. Such clients must also
+// offer a codec subprotocol for the server to select.
+const tokenSubprotocol = "controly.token."
+
+// clientToken returns the token a client authenticates with, taken from the
+// Authorization header, a token subprotocol or, unless disabled, the token
+// query parameter. Without any of them, the client's first message must be an
+// 'auth' message carrying the token.
+func (h *Hub) clientToken(r *http.Request, conn *websocket.Conn) (string, error) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token, nil
+	}
+	for _, protocol := range websocket.Subprotocols(r) {
+		if token, ok := strings.CutPrefix(protocol, tokenSubprotocol); ok {
+			return token, nil
+		}
+	}
+	if token := r.URL.Query().Get("token"); token != "" {
+		if !h.allowQueryToken {
+			return "", domain.NewError(domain.ErrAuthenticationFailed, "tokens in the query string are not accepted")
+		}
+		hotLog.Log(slog.Default(), slog.LevelWarn, "query_token", "Token in the query string is deprecated", "remote_addr", r.RemoteAddr)
+		return token, nil
+	}
+	return h.readAuthMessage(conn)
+}
+
+// readAuthMessage waits for an 'auth' message and returns its token.
+func (h *Hub) readAuthMessage(conn *websocket.Conn) (string, error) {
+	conn.SetReadLimit(h.maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(h.authTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	frameType, data, err := conn.ReadMessage()
+	if err != nil {
+		return "", domain.NewError(domain.ErrAuthenticationFailed, "no credentials received")
+	}
+	if frameType == websocket.BinaryMessage {
+		if data, err = codec.Lookup(conn.Subprotocol()).ToJSON(data); err != nil {
+			return "", domain.NewError(domain.ErrInvalidMessageFormat, "invalid auth message: %v", err)
+		}
+	}
+	var msg domain.IncomingMessage
+	var payload domain.AuthPayload
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "auth" {
+		return "", domain.NewError(domain.ErrAuthenticationFailed, "first message must be an auth message")
+	}
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil || payload.Token == "" {
+		return "", domain.NewError(domain.ErrAuthenticationFailed, "auth message is missing token")
+	}
+	return payload.Token, nil
+}
+
+// verifyToken verifies a client's JWT and checks that it was issued for role.
+func (h *Hub) verifyToken(token, role string) (*jwtauth.Claims, error) {
+	if token == "" {
+		return nil, domain.NewError(domain.ErrAuthenticationFailed, "missing token")
+	}
+	claims, err := h.jwt.Verify(token)
+	if err != nil {
+		return nil, domain.NewError(domain.ErrAuthenticationFailed, "invalid token: %v", err)
+	}
+	if claims.Role != role {
+		return nil, domain.NewError(domain.ErrAuthenticationFailed, "token is not valid for %s clients", role)
+	}
+	return claims, nil
+}
+
+// authorizeDisplay checks that a display may register with the requested ID
+// and returns the ID to register it with, which is empty if the hub should
+// generate one. A verified client certificate takes the place of a token and
+// decides the ID. The claims are nil unless the display presented a JWT.
+func (h *Hub) authorizeDisplay(r *http.Request, conn *websocket.Conn, displayID string) (string, *jwtauth.Claims, error) {
+	if cert := clientCert(r); cert != nil {
+		if !slices.Contains(cert.Subject.OrganizationalUnit, certRoleDisplay) {
+			return "", nil, domain.NewError(domain.ErrAuthenticationFailed, "client certificate does not grant the display role")
+		}
+		ids := certDisplayIDs(cert)
+		if displayID == "" && len(ids) > 0 {
+			return ids[0], nil, nil
+		}
+		if !slices.Contains(ids, displayID) {
+			return "", nil, domain.NewError(domain.ErrAuthenticationFailed, "client certificate does not match display ID: %s", displayID)
+		}
+		return displayID, nil, nil
+	}
+
+	if h.serverToken == "" && h.jwt == nil {
+		return displayID, nil, nil
+	}
+	token, err := h.clientToken(r, conn)
+	if err != nil {
+		return "", nil, err
+	}
+	if h.serverToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.serverToken)) == 1 {
+		return displayID, nil, nil
+	}
+	if h.jwt == nil {
+		return "", nil, domain.NewError(domain.ErrAuthenticationFailed, "invalid token")
+	}
+
+	claims, err := h.verifyToken(token, jwtauth.RoleDisplay)
+	if err != nil {
+		return "", nil, err
+	}
+	if displayID == "" {
+		// Use the first ID the token names, or generate one if it allows all.
+		for _, id := range claims.Displays {
+			if id != jwtauth.AllDisplays {
+				return id, claims, nil
+			}
+		}
+	}
+	if !claims.AllowsDisplay(displayID) {
+		return "", nil, domain.NewError(domain.ErrAuthenticationFailed, "token does not allow display ID: %s", displayID)
+	}
+	return displayID, claims, nil
+}
+
+// authorizeController checks that a controller may connect and returns the
+// claims that restrict it, if any.
+func (h *Hub) authorizeController(r *http.Request, conn *websocket.Conn) (*jwtauth.Claims, error) {
+	if cert := clientCert(r); cert != nil {
+		if !slices.Contains(cert.Subject.OrganizationalUnit, certRoleController) {
+			return nil, domain.NewError(domain.ErrAuthenticationFailed, "client certificate does not grant the controller role")
+		}
+		return nil, nil
+	}
+	if h.jwt == nil {
+		return nil, nil
+	}
+	token, err := h.clientToken(r, conn)
+	if err != nil {
+		return nil, err
+	}
+	return h.verifyToken(token, jwtauth.RoleController)
+}
+
+// authorizeInspector checks that an inspector may connect. Requests that
+// passed AdminAuth need no token.
+func (h *Hub) authorizeInspector(r *http.Request, conn *websocket.Conn) (*jwtauth.Claims, error) {
+	if h.jwt == nil || isAdmin(r) {
+		return nil, nil
+	}
+	token, err := h.clientToken(r, conn)
+	if err != nil {
+		return nil, err
+	}
+	return h.verifyToken(token, jwtauth.RoleInspector)
+}
+
+// controllerClaims returns the claims of a connected controller, or nil if
+// its access is not restricted.
+func (h *Hub) controllerClaims(controllerID string) *jwtauth.Claims {
+	if c, ok := h.controllers.Load(controllerID); ok {
+		return c.(*Client).claims
+	}
+	return nil
+}
+
+// restrictSession drops the subscriptions and waiting list entries of a
+// resumed controller session that its new token does not allow. The session
+// may have been created with a token that allowed more displays.
+func (h *Hub) restrictSession(controller *domain.Controller, claims *jwtauth.Claims) {
+	controller.Mu.Lock()
+	var revoked []string
+	for displayID := range controller.Subscriptions {
+		if !claims.AllowsDisplay(displayID) {
+			revoked = append(revoked, displayID)
+		}
+	}
+	changed := false
+	for displayID := range controller.WaitingFor {
+		if !claims.AllowsDisplay(displayID) {
+			delete(controller.WaitingFor, displayID)
+			changed = true
+		}
+	}
+	controller.Mu.Unlock()
+
+	if len(revoked) > 0 {
+		h.clientLog(controller.ID).Info("Dropping subscriptions the new token does not allow", "display_ids", revoked)
+		h.handleUnsubscribe(controller.ID, revoked)
+	} else if changed {
+		h.touchController(controller.ID)
+	}
+}
+
+// expireWithToken closes a client's connection when its token expires. The
+// client can reconnect with a new token and resume its session.
+func (h *Hub) expireWithToken(client *Client) {
+	if client.claims == nil || client.claims.ExpiresAt == nil {
+		return
+	}
+	client.expiry = time.AfterFunc(time.Until(client.claims.ExpiresAt.Time), func() {
+		client.log.Info("Token expired, closing connection")
+		msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "token expired")
+		client.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(h.writeWait))
+		client.conn.Close()
+	})
+}
@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/simbafs/controly/server/internal/config"
+	"github.com/simbafs/controly/server/internal/domain"
+	"github.com/simbafs/controly/server/internal/jwtauth"
+)
+
+const testJWTSecret = "secret"
+
+// startJWTHub runs a hub with cfg that requires JWTs signed with testJWTSecret.
+func startJWTHub(t *testing.T, cfg *config.Config) *httptest.Server {
+	t.Helper()
+	cfg.Auth.JWTSecret = testJWTSecret
+	hub := NewHub(cfg)
+	verifier, err := jwtauth.NewVerifier(testJWTSecret, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub.UseJWT(verifier)
+	return serveHub(t, hub)
+}
+
+// signToken returns a token for role that allows displays.
+func signToken(t *testing.T, role string, displays ...string) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwtauth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+		Role:             role,
+		Displays:         displays,
+	}).SignedString([]byte(testJWTSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// bearer returns a header with a token for role that allows displays.
+func bearer(t *testing.T, role string, displays ...string) http.Header {
+	t.Helper()
+	return http.Header{"Authorization": {"Bearer " + signToken(t, role, displays...)}}
+}
+
+func TestResumedSessionIsRestrictedToNewToken(t *testing.T) {
+	commands := commandServer(t)
+	srv := startJWTHub(t, config.Default())
+
+	displays := map[string]*testClient{}
+	for _, id := range []string{"d1", "d2"} {
+		displays[id] = dialClient(t, wsURL(srv, "/ws?type=display&id="+id+"&command_url="+url.QueryEscape(commands.URL)),
+			bearer(t, jwtauth.RoleDisplay, id))
+		displays[id].expect("set_id")
+	}
+
+	controller := dialClient(t, wsURL(srv, "/ws?type=controller&id=c1"), bearer(t, jwtauth.RoleController, "*"))
+	setID := controller.expectSetID()
+	controller.send(`{"type":"subscribe","payload":{"display_ids":["d1","d2"]}}`)
+	controller.expect("command_list")
+	controller.expect("command_list")
+	displays["d2"].expect("subscribed")
+	controller.conn.Close()
+
+	// Resume the session with a token that only allows d1.
+	controller = dialClient(t, wsURL(srv, "/ws?type=controller&id=c1&resume_token="+setID.ResumeToken),
+		bearer(t, jwtauth.RoleController, "d1"))
+	controller.expect("set_id")
+	displays["d2"].expect("unsubscribed")
+	if from := string(controller.expect("command_list")["from"]); from != `"d1"` {
+		t.Fatalf("resumed session got command_list from %s, want only d1's", from)
+	}
+
+	displays["d2"].send(`{"type":"status","payload":{"from":"d2"}}`)
+	time.Sleep(100 * time.Millisecond)
+	displays["d1"].send(`{"type":"status","payload":{"from":"d1"}}`)
+	if got := string(controller.expect("status")["payload"]); got != `{"from":"d1"}` {
+		t.Errorf("resumed session got status %s, want only d1's", got)
+	}
+}
+
+// certRequest returns a request that presented a verified client certificate
+// with the given subject and DNS SANs.
+func certRequest(subject pkix.Name, dnsNames ...string) *http.Request {
+	r := httptest.NewRequest("GET", "/ws", nil)
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: subject, DNSNames: dnsNames}}}}
+	return r
+}
+
+func TestClientCertificateAuthorizesDisplay(t *testing.T) {
+	hub := NewHub(config.Default())
+	tests := []struct {
+		name      string
+		subject   pkix.Name
+		dnsNames  []string
+		displayID string
+		want      string
+		wantErr   bool
+	}{
+		{"ID from common name", pkix.Name{CommonName: "d1", OrganizationalUnit: []string{"display"}}, nil, "", "d1", false},
+		{"requested common name", pkix.Name{CommonName: "d1", OrganizationalUnit: []string{"display"}}, nil, "d1", "d1", false},
+		{"requested DNS name", pkix.Name{CommonName: "d1", OrganizationalUnit: []string{"display"}}, []string{"d2"}, "d2", "d2", false},
+		{"ID from DNS name", pkix.Name{OrganizationalUnit: []string{"display"}}, []string{"d2"}, "", "d2", false},
+		{"role among other units", pkix.Name{CommonName: "d1", OrganizationalUnit: []string{"lobby", "display"}}, nil, "d1", "d1", false},
+		{"ID not in certificate", pkix.Name{CommonName: "d1", OrganizationalUnit: []string{"display"}}, []string{"d2"}, "d3", "", true},
+		{"controller certificate", pkix.Name{CommonName: "d1", OrganizationalUnit: []string{"controller"}}, nil, "d1", "", true},
+		{"no role", pkix.Name{CommonName: "d1"}, nil, "d1", "", true},
+		{"role in organization", pkix.Name{CommonName: "d1", Organization: []string{"display"}}, nil, "d1", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, claims, err := hub.authorizeDisplay(certRequest(tt.subject, tt.dnsNames...), nil, tt.displayID)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got ID %q, want an error", id)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != tt.want || claims != nil {
+				t.Errorf("got ID %q and claims %v, want %q and no claims", id, claims, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientCertificateAuthorizesController(t *testing.T) {
+	hub := NewHub(config.Default())
+	tests := []struct {
+		name    string
+		units   []string
+		wantErr bool
+	}{
+		{"controller", []string{"controller"}, false},
+		{"role among other units", []string{"ops", "controller"}, false},
+		{"display certificate", []string{"display"}, true},
+		{"no role", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := hub.authorizeController(certRequest(pkix.Name{CommonName: "c1", OrganizationalUnit: tt.units}), nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClientTokenSources(t *testing.T) {
+	token := signToken(t, jwtauth.RoleController, "*")
+	tests := []struct {
+		name          string
+		disallowQuery bool
+		query         string
+		header        http.Header
+		firstMessage  string
+		wantErr       bool
+	}{
+		{name: "authorization header", header: http.Header{"Authorization": {"Bearer " + token}}},
+		{name: "subprotocol", header: http.Header{"Sec-WebSocket-Protocol": {"controly.json.v1, " + tokenSubprotocol + token}}},
+		{name: "query parameter", query: "&token=" + token},
+		{name: "auth message", firstMessage: `{"type":"auth","payload":{"token":"` + token + `"}}`},
+		{name: "disallowed query parameter", disallowQuery: true, query: "&token=" + token, wantErr: true},
+		{name: "auth message without token", firstMessage: `{"type":"auth","payload":{}}`, wantErr: true},
+		{name: "other first message", firstMessage: `{"type":"subscribe","payload":{"display_ids":["d1"]}}`, wantErr: true},
+		{name: "invalid token", header: http.Header{"Authorization": {"Bearer " + token + "x"}}, wantErr: true},
+		{name: "token for another role", header: bearer(t, jwtauth.RoleDisplay, "*"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.Auth.AllowQueryToken = !tt.disallowQuery
+			srv := startJWTHub(t, cfg)
+			controller := dialClient(t, wsURL(srv, "/ws?type=controller"+tt.query), tt.header)
+			if tt.firstMessage != "" {
+				controller.send(tt.firstMessage)
+			}
+			if tt.wantErr {
+				controller.expectError(domain.ErrAuthenticationFailed)
+			} else {
+				controller.expect("set_id")
+			}
+		})
+	}
+}
+
+func TestAuthMessageTimesOut(t *testing.T) {
+	cfg := config.Default()
+	cfg.Timeouts.Auth = 100 * time.Millisecond
+	srv := startJWTHub(t, cfg)
+
+	start := time.Now()
+	controller := dialClient(t, wsURL(srv, "/ws?type=controller"), nil)
+	controller.expectError(domain.ErrAuthenticationFailed)
+	if elapsed := time.Since(start); elapsed < cfg.Timeouts.Auth {
+		t.Errorf("rejected after %v, before the auth timeout of %v", elapsed, cfg.Timeouts.Auth)
+	}
+	if _, open := <-controller.messages; open {
+		t.Error("connection stayed open after the auth timeout")
+	}
+}
@@ -0,0 +1,123 @@
+// Package certs serves TLS certificates that are reloaded when they change.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloader serves a certificate from a certificate and key file, and reloads
+// it when the files change so that renewed certificates are used without a
+// restart. Established connections keep the certificate they were made with.
+type Reloader struct {
+	certFile string
+	keyFile  string
+
+	mu    sync.RWMutex
+	cert  *tls.Certificate
+	stamp string // Modification times and sizes of the loaded files
+}
+
+// NewReloader loads the certificate.
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the certificate from its files. The current certificate is kept
+// if they are invalid.
+func (r *Reloader) Reload() error {
+	stamp, err := r.fileStamp()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.stamp = stamp
+	r.mu.Unlock()
+	return nil
+}
+
+// GetCertificate is the tls.Config.GetCertificate callback.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// GetClientCertificate is the tls.Config.GetClientCertificate callback, for
+// presenting the certificate as a client.
+func (r *Reloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Watch reloads the certificate whenever its files change, checking every
+// interval until done is closed. Polling also notices files that are replaced
+// through symlinks, as in mounted Kubernetes secrets.
+func (r *Reloader) Watch(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	failed := "" // Stamp of files that failed to load, so they are reported once
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		stamp, err := r.fileStamp()
+		r.mu.RLock()
+		unchanged := stamp == r.stamp
+		r.mu.RUnlock()
+		if err != nil || unchanged || stamp == failed {
+			continue
+		}
+		// Certificate and key are rarely written at the same instant, so a
+		// failure is retried once the files change again.
+		if err := r.Reload(); err != nil {
+			failed = stamp
+			slog.Warn("Could not reload TLS certificate, keeping the current one", "error", err)
+			continue
+		}
+		slog.Info("Reloaded TLS certificate", "cert_file", r.certFile)
+	}
+}
+
+func (r *Reloader) fileStamp() (string, error) {
+	stamp := ""
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return "", err
+		}
+		stamp += fmt.Sprintf("%d/%d;", info.ModTime().UnixNano(), info.Size())
+	}
+	return stamp, nil
+}
+
+// LoadPool reads the PEM certificates in file into a pool, e.g. the CAs that
+// client certificates are verified against.
+func LoadPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
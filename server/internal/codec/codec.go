@@ -0,0 +1,149 @@
+// Package codec translates messages between the hub's internal JSON format and
+// the wire encoding a client negotiated through the WebSocket subprotocol.
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec converts messages between JSON and a client's wire encoding.
+type Codec interface {
+	// Name is the WebSocket subprotocol that selects the codec.
+	Name() string
+	// FrameType is the WebSocket message type used on the wire.
+	FrameType() int
+	// FromJSON encodes a JSON message for the wire.
+	FromJSON(data []byte) ([]byte, error)
+	// ToJSON decodes a message from the wire into JSON.
+	ToJSON(data []byte) ([]byte, error)
+}
+
+// JSON is the default codec, used when a client does not request a subprotocol.
+var JSON Codec = jsonCodec{}
+
+var codecs = map[string]Codec{
+	"controly.json.v1":    JSON,
+	"controly.msgpack.v1": msgpackCodec{},
+	"controly.cbor.v1":    cborCodec{},
+}
+
+// Subprotocols lists the supported subprotocols in order of preference.
+func Subprotocols() []string {
+	return []string{"controly.msgpack.v1", "controly.cbor.v1", "controly.json.v1"}
+}
+
+// Lookup returns the codec for a negotiated subprotocol, falling back to JSON.
+func Lookup(subprotocol string) Codec {
+	if c, ok := codecs[subprotocol]; ok {
+		return c
+	}
+	return JSON
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                         { return "controly.json.v1" }
+func (jsonCodec) FrameType() int                       { return websocket.TextMessage }
+func (jsonCodec) FromJSON(data []byte) ([]byte, error) { return data, nil }
+func (jsonCodec) ToJSON(data []byte) ([]byte, error)   { return data, nil }
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string   { return "controly.msgpack.v1" }
+func (msgpackCodec) FrameType() int { return websocket.BinaryMessage }
+
+func (msgpackCodec) FromJSON(data []byte) ([]byte, error) {
+	v, err := decodeJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) ToJSON(data []byte) ([]byte, error) {
+	var v any
+	if err := msgpack.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+var cborDecMode, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]any(nil)),
+}.DecMode()
+
+type cborCodec struct{}
+
+func (cborCodec) Name() string   { return "controly.cbor.v1" }
+func (cborCodec) FrameType() int { return websocket.BinaryMessage }
+
+func (cborCodec) FromJSON(data []byte) ([]byte, error) {
+	v, err := decodeJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	return cbor.Marshal(v)
+}
+
+func (cborCodec) ToJSON(data []byte) ([]byte, error) {
+	var v any
+	if err := cborDecMode.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// decodeJSON decodes data into plain Go values, keeping integers as int64, or
+// uint64 above its range, so that binary encodings do not turn them into
+// floats.
+func decodeJSON(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return convertNumbers(v)
+}
+
+func convertNumbers(v any) (any, error) {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return u, nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s: %w", v, err)
+		}
+		return f, nil
+	case map[string]any:
+		for k, e := range v {
+			c, err := convertNumbers(e)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = c
+		}
+	case []any:
+		for i, e := range v {
+			c, err := convertNumbers(e)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = c
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,101 @@
+package codec
+
+import (
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var binaryCodecs = []Codec{Lookup("controly.msgpack.v1"), Lookup("controly.cbor.v1")}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+	}{
+		{"integers", `{"max":9223372036854775807,"min":-9223372036854775808,"negative":-42,"zero":0}`},
+		{"large unsigned integer", `{"n":18446744073709551615}`},
+		{"integer above float precision", `{"n":9007199254740993}`},
+		{"floats", `{"half":0.5,"negative":-1.25}`},
+		{"nested maps", `{"a":{"b":{"c":[1,{"d":"e"}],"f":null}},"g":[[true,false]]}`},
+		{"strings", `{"empty":"","text":"héllo"}`},
+	}
+	for _, c := range binaryCodecs {
+		for _, tt := range tests {
+			t.Run(c.Name()+"/"+tt.name, func(t *testing.T) {
+				wire, err := c.FromJSON([]byte(tt.json))
+				if err != nil {
+					t.Fatalf("FromJSON: %v", err)
+				}
+				got, err := c.ToJSON(wire)
+				if err != nil {
+					t.Fatalf("ToJSON: %v", err)
+				}
+				if string(got) != tt.json {
+					t.Errorf("round trip gave %s, want %s", got, tt.json)
+				}
+			})
+		}
+	}
+}
+
+func TestToJSON(t *testing.T) {
+	msgpackData := func(v any) []byte {
+		data, err := msgpack.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	cborData := func(v any) []byte {
+		data, err := cbor.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	tests := []struct {
+		name    string
+		codec   Codec
+		data    []byte
+		want    string
+		wantErr bool
+	}{
+		{"msgpack binary", binaryCodecs[0], msgpackData(map[string]any{"b": []byte{1, 2, 3}}), `{"b":"AQID"}`, false},
+		{"cbor binary", binaryCodecs[1], cborData(map[string]any{"b": []byte{1, 2, 3}}), `{"b":"AQID"}`, false},
+		{"msgpack unsigned integer", binaryCodecs[0], msgpackData(map[string]any{"n": uint64(1) << 63}), `{"n":9223372036854775808}`, false},
+		{"cbor unsigned integer", binaryCodecs[1], cborData(map[string]any{"n": uint64(1) << 63}), `{"n":9223372036854775808}`, false},
+		{"msgpack integer keys", binaryCodecs[0], msgpackData(map[int]string{1: "a"}), "", true},
+		{"cbor integer keys", binaryCodecs[1], cborData(map[int]string{1: "a"}), "", true},
+		{"msgpack nested integer keys", binaryCodecs[0], msgpackData(map[string]any{"a": map[bool]int{true: 1}}), "", true},
+		{"cbor nested integer keys", binaryCodecs[1], cborData(map[string]any{"a": map[bool]int{true: 1}}), "", true},
+		{"msgpack truncated", binaryCodecs[0], msgpackData(map[string]any{"a": "b"})[:3], "", true},
+		{"cbor truncated", binaryCodecs[1], cborData(map[string]any{"a": "b"})[:3], "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.codec.ToJSON(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %s, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFromJSONRejectsInvalidJSON(t *testing.T) {
+	for _, c := range binaryCodecs {
+		if _, err := c.FromJSON([]byte(`{"a":`)); err == nil {
+			t.Errorf("%s accepted invalid JSON", c.Name())
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/simbafs/controly/server/internal/domain"
+	"github.com/simbafs/controly/server/internal/federation"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// pendingCommand is a command with an ID that is waiting for a 'command_result'
+// from its display.
+type pendingCommand struct {
+	controllerID string
+	displayID    string
+	commandID    string              // ID chosen by the controller
+	timer        *time.Timer         // nil when command timeouts are disabled
+	trace        domain.TraceContext // Trace context the command was forwarded with
+}
+
+func (p *pendingCommand) stopTimer() {
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+}
+
+// handleCommand validates a command from a controller and forwards it to the
+// target display. Unless the hub is an open relay, the controller must be
+// subscribed to the display.
+func (h *Hub) handleCommand(controllerID string, msg *domain.IncomingMessage) {
+	ctx, span := tracer.Start(traceContext(msg.Trace), "command.receive", trace.WithAttributes(
+		attribute.String("controly.controller_id", controllerID),
+		attribute.String("controly.display_id", msg.To),
+	))
+	defer span.End()
+	fail := func(err error) {
+		recordError(span, err)
+		h.sendError(controllerID, err)
+	}
+
+	var payload domain.CommandPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil || payload.Name == "" {
+		fail(domain.NewError(domain.ErrInvalidCommandFormat, "command payload must be an object with a name"))
+		return
+	}
+	span.SetAttributes(attribute.String("controly.command", payload.Name))
+
+	if msg.To == "" {
+		fail(domain.NewError(domain.ErrTargetDisplayNotFound, "command is missing target display: to"))
+		return
+	}
+
+	if claims := h.controllerClaims(controllerID); claims != nil {
+		if claims.ReadOnly {
+			fail(domain.NewError(domain.ErrPermissionDenied, "token is read-only"))
+			return
+		}
+		if !claims.AllowsDisplay(msg.To) {
+			fail(domain.NewError(domain.ErrPermissionDenied, "not allowed to command display: %s", msg.To))
+			return
+		}
+	}
+
+	if _, ok := h.displayEntities.Load(msg.To); !ok {
+		if node, ok := h.remoteDisplayNode(msg.To); ok {
+			if !h.openRelay && !h.isSubscribed(controllerID, msg.To) {
+				fail(domain.NewError(domain.ErrNotSubscribedToDisplay, "not subscribed to display: %s", msg.To))
+				return
+			}
+			// The display's node validates and tracks the command.
+			span.SetAttributes(attribute.String("controly.node", node))
+			h.federate(node, &federation.Envelope{
+				Type:       federation.TypeCommand,
+				Controller: controllerID,
+				Display:    msg.To,
+				ID:         msg.ID,
+				Message:    msg.Payload,
+				Trace:      traceFields(ctx),
+			})
+			return
+		}
+		if h.openRelay {
+			h.deliver([]string{msg.To}, domain.OutgoingMessage{
+				Type:    "command",
+				From:    controllerID,
+				Payload: msg.Payload,
+				Trace:   traceFields(ctx),
+			})
+			return
+		}
+		fail(domain.NewError(domain.ErrTargetDisplayNotFound, "target display not found: %s", msg.To))
+		return
+	}
+
+	h.dispatchCommand(ctx, controllerID, msg.To, msg.ID, msg.Payload, &payload)
+}
+
+// dispatchCommand forwards a parsed command to a display on this node. The
+// controller may be on another node.
+func (h *Hub) dispatchCommand(ctx context.Context, controllerID, displayID, commandID string, raw json.RawMessage, payload *domain.CommandPayload) {
+	ctx, span := tracer.Start(ctx, "command.dispatch", trace.WithAttributes(
+		attribute.String("controly.controller_id", controllerID),
+		attribute.String("controly.display_id", displayID),
+		attribute.String("controly.command", payload.Name),
+	))
+	defer span.End()
+	fail := func(err error) {
+		recordError(span, err)
+		h.sendError(controllerID, err)
+	}
+
+	d, ok := h.displayEntities.Load(displayID)
+	if !ok {
+		fail(domain.NewError(domain.ErrTargetDisplayNotFound, "target display not found: %s", displayID))
+		return
+	}
+	display := d.(*domain.Display)
+	if contains(&h.detachedDisplays, displayID) {
+		fail(domain.NewError(domain.ErrTargetDisplayNotFound, "target display is reconnecting: %s", displayID))
+		return
+	}
+
+	if !h.openRelay {
+		display.Mu.Lock()
+		subscribed := display.Subscribers[controllerID]
+		display.Mu.Unlock()
+		if !subscribed {
+			fail(domain.NewError(domain.ErrNotSubscribedToDisplay, "not subscribed to display: %s", displayID))
+			return
+		}
+	}
+
+	if err := display.ValidateCommand(payload); err != nil {
+		fail(err)
+		return
+	}
+
+	out := domain.OutgoingMessage{
+		Type:    "command",
+		From:    controllerID,
+		Payload: raw,
+		Trace:   traceFields(ctx),
+	}
+	if commandID != "" {
+		out.ID = h.trackCommand(controllerID, displayID, commandID, out.Trace)
+	}
+	h.deliver([]string{displayID}, out)
+}
+
+// isSubscribed reports whether a local controller is subscribed to a display.
+func (h *Hub) isSubscribed(controllerID, displayID string) bool {
+	c, ok := h.controllerEntities.Load(controllerID)
+	if !ok {
+		return false
+	}
+	controller := c.(*domain.Controller)
+	controller.Mu.Lock()
+	defer controller.Mu.Unlock()
+	return controller.Subscriptions[displayID]
+}
+
+// trackCommand records a command sent with an ID and returns the ID to forward
+// to the display. The hub uses its own IDs so that IDs chosen by different
+// controllers never collide.
+func (h *Hub) trackCommand(controllerID, displayID, commandID string, tc domain.TraceContext) string {
+	forwardID := strconv.FormatUint(h.nextCommandID.Add(1), 10)
+	pending := &pendingCommand{
+		controllerID: controllerID,
+		displayID:    displayID,
+		commandID:    commandID,
+		trace:        tc,
+	}
+	if h.commandTimeout > 0 {
+		pending.timer = time.AfterFunc(h.commandTimeout, func() {
+			if _, ok := h.pendingCommands.LoadAndDelete(forwardID); ok {
+				h.sendCommandResult(traceContext(pending.trace), pending, domain.CommandResultPayload{
+					Status: domain.CommandResultTimeout,
+					Error:  "display did not respond within " + h.commandTimeout.String(),
+				})
+			}
+		})
+	}
+	h.pendingCommands.Store(forwardID, pending)
+	return forwardID
+}
+
+// handleCommandResult routes a 'command_result' from a display back to the
+// controller that sent the command.
+func (h *Hub) handleCommandResult(displayID string, msg *domain.IncomingMessage) {
+	var payload domain.CommandResultPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		h.sendError(displayID, domain.NewError(domain.ErrInvalidMessageFormat, "invalid command_result payload: %v", err))
+		return
+	}
+	if payload.Status != domain.CommandResultSuccess && payload.Status != domain.CommandResultError {
+		h.sendError(displayID, domain.NewError(domain.ErrInvalidMessageFormat, "command_result status must be %q or %q", domain.CommandResultSuccess, domain.CommandResultError))
+		return
+	}
+
+	p, ok := h.pendingCommands.Load(msg.ID)
+	if !ok || p.(*pendingCommand).displayID != displayID {
+		h.sendError(displayID, domain.NewError(domain.ErrInvalidMessageFormat, "no pending command with id: %s", msg.ID))
+		return
+	}
+	pending := p.(*pendingCommand)
+	if !h.pendingCommands.CompareAndDelete(msg.ID, pending) {
+		// Timed out in the meantime.
+		return
+	}
+	pending.stopTimer()
+	// The display continues the command's trace if it supports tracing.
+	ctx := traceContext(msg.Trace)
+	if len(msg.Trace) == 0 {
+		ctx = traceContext(pending.trace)
+	}
+	h.sendCommandResult(ctx, pending, payload)
+}
+
+// failPendingCommands resolves every pending command of a display with an error.
+func (h *Hub) failPendingCommands(displayID, reason string) {
+	h.pendingCommands.Range(func(key, value any) bool {
+		pending := value.(*pendingCommand)
+		if pending.displayID == displayID && h.pendingCommands.CompareAndDelete(key, pending) {
+			pending.stopTimer()
+			h.sendCommandResult(traceContext(pending.trace), pending, domain.CommandResultPayload{
+				Status: domain.CommandResultError,
+				Error:  reason,
+			})
+		}
+		return true
+	})
+}
+
+func (h *Hub) sendCommandResult(ctx context.Context, pending *pendingCommand, payload domain.CommandResultPayload) {
+	ctx, span := tracer.Start(ctx, "command.result", trace.WithAttributes(
+		attribute.String("controly.controller_id", pending.controllerID),
+		attribute.String("controly.display_id", pending.displayID),
+		attribute.String("controly.result", payload.Status),
+	))
+	defer span.End()
+	if payload.Status != domain.CommandResultSuccess {
+		span.SetStatus(codes.Error, payload.Error)
+	}
+
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		slog.Error("Error marshalling command result", "error", err)
+		return
+	}
+	h.deliver([]string{pending.controllerID}, domain.OutgoingMessage{
+		Type:    "command_result",
+		From:    pending.displayID,
+		ID:      pending.commandID,
+		Payload: payloadBytes,
+		Trace:   traceFields(ctx),
+	})
+}
@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/simbafs/controly/server/internal/config"
+	"github.com/simbafs/controly/server/internal/domain"
+)
+
+// startCommandHub runs a hub with a display d1 and the given controllers
+// subscribed to it.
+func startCommandHub(t *testing.T, cfg *config.Config, controllerIDs ...string) (*httptest.Server, *testClient, map[string]*testClient) {
+	t.Helper()
+	commands := commandServer(t)
+	hub := NewHub(cfg)
+	srv := serveHub(t, hub)
+
+	display := dialClient(t, wsURL(srv, "/ws?type=display&id=d1&command_url="+commands.URL), nil)
+	display.expect("set_id")
+	controllers := map[string]*testClient{}
+	for _, id := range controllerIDs {
+		controller := dialClient(t, wsURL(srv, "/ws?type=controller&id="+id), nil)
+		controller.expect("set_id")
+		controller.send(`{"type":"subscribe","payload":{"display_ids":["d1"]}}`)
+		controller.expect("command_list")
+		display.expect("subscribed")
+		controllers[id] = controller
+	}
+	return srv, display, controllers
+}
+
+// expectCommand waits for a command and returns the ID the hub forwarded it with.
+func expectCommand(c *testClient) string {
+	c.t.Helper()
+	var id string
+	if err := json.Unmarshal(c.expect("command")["id"], &id); err != nil || id == "" {
+		c.t.Fatalf("command without an id: %v", err)
+	}
+	return id
+}
+
+// expectCommandResult waits for a command_result and checks its ID and status.
+func expectCommandResult(c *testClient, id, status string) domain.CommandResultPayload {
+	c.t.Helper()
+	msg := c.expect("command_result")
+	var gotID string
+	var payload domain.CommandResultPayload
+	json.Unmarshal(msg["id"], &gotID)
+	if err := json.Unmarshal(msg["payload"], &payload); err != nil {
+		c.t.Fatalf("command_result payload: %v", err)
+	}
+	if gotID != id || payload.Status != status {
+		c.t.Fatalf("got command_result %q with status %q (%s), want %q with %q", gotID, payload.Status, payload.Error, id, status)
+	}
+	return payload
+}
+
+func TestCommandResultReachesIssuingController(t *testing.T) {
+	_, display, controllers := startCommandHub(t, config.Default(), "c1", "c2")
+
+	// Both controllers pick the same ID; the display sees two different ones.
+	controllers["c1"].send(`{"type":"command","to":"d1","id":"a","payload":{"name":"set_time","args":{"value":1}}}`)
+	first := expectCommand(display)
+	controllers["c2"].send(`{"type":"command","to":"d1","id":"a","payload":{"name":"set_time","args":{"value":2}}}`)
+	second := expectCommand(display)
+	if first == second {
+		t.Fatalf("both commands were forwarded with id %q", first)
+	}
+
+	display.send(`{"type":"command_result","id":"` + second + `","payload":{"status":"success","result":2}}`)
+	display.send(`{"type":"command_result","id":"` + first + `","payload":{"status":"error","error":"busy"}}`)
+	if got := expectCommandResult(controllers["c2"], "a", domain.CommandResultSuccess); string(got.Result) != "2" {
+		t.Errorf("c2 got result %s, want 2", got.Result)
+	}
+	// c1 receives its own result first, so c2's never reached it.
+	if got := expectCommandResult(controllers["c1"], "a", domain.CommandResultError); got.Error != "busy" {
+		t.Errorf("c1 got error %q, want busy", got.Error)
+	}
+
+	// A result is delivered once.
+	display.send(`{"type":"command_result","id":"` + first + `","payload":{"status":"success"}}`)
+	display.expectError(domain.ErrInvalidMessageFormat)
+}
+
+func TestCommandResultFromOtherDisplayIsRejected(t *testing.T) {
+	commands := commandServer(t)
+	cfg := config.Default()
+	cfg.Timeouts.Command = 0
+	srv, display, controllers := startCommandHub(t, cfg, "c1")
+	other := dialClient(t, wsURL(srv, "/ws?type=display&id=d2&command_url="+commands.URL), nil)
+	other.expect("set_id")
+
+	controllers["c1"].send(`{"type":"command","to":"d1","id":"a","payload":{"name":"set_time","args":{"value":1}}}`)
+	id := expectCommand(display)
+	other.send(`{"type":"command_result","id":"` + id + `","payload":{"status":"success"}}`)
+	other.expectError(domain.ErrInvalidMessageFormat)
+
+	// The command is still pending for its display.
+	display.send(`{"type":"command_result","id":"` + id + `","payload":{"status":"success"}}`)
+	expectCommandResult(controllers["c1"], "a", domain.CommandResultSuccess)
+}
+
+func TestCommandTimesOut(t *testing.T) {
+	cfg := config.Default()
+	cfg.Timeouts.Command = 100 * time.Millisecond
+	_, display, controllers := startCommandHub(t, cfg, "c1")
+
+	controllers["c1"].send(`{"type":"command","to":"d1","id":"a","payload":{"name":"set_time","args":{"value":1}}}`)
+	id := expectCommand(display)
+	expectCommandResult(controllers["c1"], "a", domain.CommandResultTimeout)
+
+	// A late result is rejected.
+	display.send(`{"type":"command_result","id":"` + id + `","payload":{"status":"success"}}`)
+	display.expectError(domain.ErrInvalidMessageFormat)
+}
+
+func TestPendingCommandsFailWhenDisplayLeaves(t *testing.T) {
+	cfg := config.Default()
+	cfg.Timeouts.Command = 0
+	cfg.Timeouts.DisplayResumeGrace = 0
+	_, display, controllers := startCommandHub(t, cfg, "c1")
+
+	controllers["c1"].send(`{"type":"command","to":"d1","id":"a","payload":{"name":"set_time","args":{"value":1}}}`)
+	expectCommand(display)
+	controllers["c1"].send(`{"type":"command","to":"d1","id":"b","payload":{"name":"set_time","args":{"value":2}}}`)
+	expectCommand(display)
+	display.conn.Close()
+
+	got := map[string]bool{}
+	for range 2 {
+		msg := controllers["c1"].expect("command_result")
+		var id string
+		var payload domain.CommandResultPayload
+		json.Unmarshal(msg["id"], &id)
+		json.Unmarshal(msg["payload"], &payload)
+		if payload.Status != domain.CommandResultError {
+			t.Errorf("command %q resolved with status %q, want error", id, payload.Status)
+		}
+		got[id] = true
+	}
+	if !got["a"] || !got["b"] {
+		t.Errorf("got results for %v, want a and b", got)
+	}
+}
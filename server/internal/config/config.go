@@ -1,30 +1,582 @@
 package config
 
 import (
-	"log"
+	"bytes"
+	"compress/flate"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/simbafs/controly/server/internal/origin"
+	"gopkg.in/yaml.v3"
 )
 
 // Config holds the server's configuration.
 type Config struct {
-	Token string
-	Addr  string
+	// Addr is the address the server listens on.
+	Addr string `yaml:"addr" toml:"addr"`
+	// OpenRelay lets controllers send commands to any client, subscribed or not.
+	OpenRelay bool `yaml:"open_relay" toml:"open_relay"`
+
+	Auth        AuthConfig        `yaml:"auth" toml:"auth"`
+	Admin       AdminConfig       `yaml:"admin" toml:"admin"`
+	Origins     OriginsConfig     `yaml:"origins" toml:"origins"`
+	TLS         TLSConfig         `yaml:"tls" toml:"tls"`
+	Limits      LimitsConfig      `yaml:"limits" toml:"limits"`
+	Timeouts    TimeoutsConfig    `yaml:"timeouts" toml:"timeouts"`
+	Compression CompressionConfig `yaml:"compression" toml:"compression"`
+	Federation  FederationConfig  `yaml:"federation" toml:"federation"`
+	Store       StoreConfig       `yaml:"store" toml:"store"`
+	Log         LogConfig         `yaml:"log" toml:"log"`
+	Trace       TraceConfig       `yaml:"trace" toml:"trace"`
 }
 
-// NewConfig creates a new Config object by reading from environment variables.
-func NewConfig() *Config {
-	token := os.Getenv("CONTROLY_TOKEN")
-	if token != "" {
-		log.Println("Server token is set. Displays must provide a valid token to connect.")
-	} else {
-		log.Println("Server token is not set. Displays can connect without a token.")
+type AuthConfig struct {
+	// Token must be provided by displays to connect, if set.
+	Token string `yaml:"token" toml:"token"`
+	// JWTSecret verifies HS256 client tokens.
+	JWTSecret string `yaml:"jwt_secret" toml:"jwt_secret"`
+	// JWTPublicKey is a PEM file with the Ed25519 key that verifies EdDSA
+	// client tokens. When a JWT key is set, every client must authenticate.
+	JWTPublicKey string `yaml:"jwt_public_key" toml:"jwt_public_key"`
+	// AllowQueryToken accepts tokens in the token query parameter, where they
+	// end up in access logs. Deprecated in favour of the Authorization header,
+	// the controly.token subprotocol and the auth message.
+	AllowQueryToken bool `yaml:"allow_query_token" toml:"allow_query_token"`
+}
+
+type AdminConfig struct {
+	// APIKeys grant access to the REST API and the inspector. Both are open
+	// to anyone when empty.
+	APIKeys []string `yaml:"api_keys" toml:"api_keys"`
+	// Addr is a separate address the REST API, the inspector, federation
+	// links and metrics are served on instead of the public one, e.g. on a
+	// private network or localhost.
+	Addr string `yaml:"addr" toml:"addr"`
+}
+
+// OriginsConfig lists the origins browsers may connect from, as exact origins
+// ("https://example.com"), with one wildcard ("https://*.example.com",
+// "http://localhost:*") or "*" for any. Once a list is set, it must also name
+// the origin the relay's own pages are served from.
+type OriginsConfig struct {
+	// Allowed are the origins WebSocket connections are accepted from. All
+	// origins are accepted when empty.
+	Allowed []string `yaml:"allowed" toml:"allowed"`
+	// Display, Controller and Inspector replace Allowed for one client type.
+	Display    []string `yaml:"display" toml:"display"`
+	Controller []string `yaml:"controller" toml:"controller"`
+	Inspector  []string `yaml:"inspector" toml:"inspector"`
+	// API are the origins allowed to call the REST API by CORS. Defaults to
+	// Allowed; only the relay's own pages may call it when both are empty.
+	API []string `yaml:"api" toml:"api"`
+}
+
+// ForClient returns the origins a client type may connect from.
+func (o OriginsConfig) ForClient(clientType string) []string {
+	var origins []string
+	switch clientType {
+	case "display":
+		origins = o.Display
+	case "controller":
+		origins = o.Controller
+	case "inspector":
+		origins = o.Inspector
+	case "api":
+		origins = o.API
 	}
-	addr := os.Getenv("CONTROLY_ADDR")
-	if addr == "" {
-		addr = ":8080"
+	if len(origins) == 0 {
+		return o.Allowed
 	}
+	return origins
+}
+
+type TLSConfig struct {
+	// CertFile and KeyFile enable HTTPS when both are set. They are reloaded
+	// when they change or on SIGHUP.
+	CertFile string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile  string `yaml:"key_file" toml:"key_file"`
+	// ClientCA is a file of CA certificates that client certificates are
+	// verified against. A verified client certificate authenticates displays
+	// and controllers in place of the token.
+	ClientCA string `yaml:"client_ca" toml:"client_ca"`
+	// ClientAuth is "require" to reject connections without a client
+	// certificate. Otherwise certificates are verified when presented. The
+	// admin address never requires one.
+	ClientAuth string `yaml:"client_auth" toml:"client_auth"`
+	// RedirectAddr is an address to serve plain HTTP on, redirecting to HTTPS.
+	// Disabled when empty.
+	RedirectAddr string `yaml:"redirect_addr" toml:"redirect_addr"`
+}
+
+type LimitsConfig struct {
+	// MaxMessageSize is the largest message in bytes a client may send.
+	MaxMessageSize int64 `yaml:"max_message_size" toml:"max_message_size"`
+	// SendBufferSize is how many messages are queued for a client before
+	// further messages are dropped.
+	SendBufferSize int `yaml:"send_buffer_size" toml:"send_buffer_size"`
+	// ReadBufferSize and WriteBufferSize are the WebSocket I/O buffer sizes in bytes.
+	ReadBufferSize  int `yaml:"read_buffer_size" toml:"read_buffer_size"`
+	WriteBufferSize int `yaml:"write_buffer_size" toml:"write_buffer_size"`
+	// MaxClients caps the connected clients of all types. Zero disables the cap.
+	MaxClients int `yaml:"max_clients" toml:"max_clients"`
+	// MaxConnectionsPerIP caps the connections from one IP address. Zero
+	// disables the cap.
+	MaxConnectionsPerIP int `yaml:"max_connections_per_ip" toml:"max_connections_per_ip"`
+	// MaxViolations is how many messages over its rate limit a client may
+	// send, recovering one per second, before it is disconnected.
+	MaxViolations int `yaml:"max_violations" toml:"max_violations"`
+	// Display and Controller limit the messages each client of the type sends.
+	Display    RateConfig `yaml:"display" toml:"display"`
+	Controller RateConfig `yaml:"controller" toml:"controller"`
+}
+
+// RateConfig sets token-bucket limits on the messages a client sends. A zero
+// rate disables the limit.
+type RateConfig struct {
+	MessagesPerSecond int `yaml:"messages_per_second" toml:"messages_per_second"`
+	MessageBurst      int `yaml:"message_burst" toml:"message_burst"`
+	BytesPerSecond    int `yaml:"bytes_per_second" toml:"bytes_per_second"`
+	ByteBurst         int `yaml:"byte_burst" toml:"byte_burst"`
+}
+
+type TimeoutsConfig struct {
+	// Write is how long a write to a client may take.
+	Write time.Duration `yaml:"write" toml:"write"`
+	// Pong is how long the server waits for a client to answer a ping.
+	// Pings are sent at 9/10 of it.
+	Pong time.Duration `yaml:"pong" toml:"pong"`
+	// Auth is how long a client that did not pass a token with its request has
+	// to send an 'auth' message.
+	Auth time.Duration `yaml:"auth" toml:"auth"`
+	// Command is how long the hub waits for a display to answer a command
+	// with an ID. Zero disables timeouts.
+	Command time.Duration `yaml:"command" toml:"command"`
+	// DisplayResumeGrace is how long a disconnected display is kept as
+	// reconnecting before its subscribers are told. Zero disables reconnecting.
+	DisplayResumeGrace time.Duration `yaml:"display_resume_grace" toml:"display_resume_grace"`
+	// ControllerResumeGrace is how long a disconnected controller's session is
+	// kept so that it can be resumed with its resume token. Zero disables resuming.
+	ControllerResumeGrace time.Duration `yaml:"controller_resume_grace" toml:"controller_resume_grace"`
+	// RestoreGrace is how long sessions restored from the store wait for their
+	// clients to reconnect after a restart.
+	RestoreGrace time.Duration `yaml:"restore_grace" toml:"restore_grace"`
+	// Shutdown is how long a shutdown waits for connections to drain.
+	Shutdown time.Duration `yaml:"shutdown" toml:"shutdown"`
+	// ReconnectDelay is how long clients are told to wait before reconnecting
+	// when the server shuts down.
+	ReconnectDelay time.Duration `yaml:"reconnect_delay" toml:"reconnect_delay"`
+}
+
+type CompressionConfig struct {
+	// Enabled enables the permessage-deflate extension for clients that offer it.
+	Enabled bool `yaml:"enabled" toml:"enabled"`
+	// Level is the flate level used for compressed messages, from -2 to 9.
+	Level int `yaml:"level" toml:"level"`
+	// Threshold is the size in bytes below which messages are sent uncompressed.
+	// Clients can override it with the compression_threshold query parameter.
+	Threshold int `yaml:"threshold" toml:"threshold"`
+}
+
+type FederationConfig struct {
+	// NodeID identifies this server among federated nodes. Defaults to the host name.
+	NodeID string `yaml:"node_id" toml:"node_id"`
+	// Peers are the federation endpoints (ws://host:port/federation) of the
+	// other nodes. Federation is disabled when empty.
+	Peers []string `yaml:"peers" toml:"peers"`
+	// Secret authenticates links between nodes. It is required with peers, as
+	// linked nodes trust each other's messages.
+	Secret string `yaml:"secret" toml:"secret"`
+	// CAFile is a file of CA certificates that wss:// peers are verified
+	// against, instead of the system roots.
+	CAFile string `yaml:"ca_file" toml:"ca_file"`
+	// CertFile and KeyFile are a client certificate presented to peers that
+	// require one, e.g. with tls.client_auth set to require and no admin.addr.
+	CertFile string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile  string `yaml:"key_file" toml:"key_file"`
+}
+
+type StoreConfig struct {
+	// Path is the database file that sessions are persisted to. Sessions only
+	// live in memory when empty, and a restart with SIGUSR2 loses them.
+	Path string `yaml:"path" toml:"path"`
+}
+
+type LogConfig struct {
+	// Level is one of debug, info, warn or error.
+	Level string `yaml:"level" toml:"level"`
+	// Format is text or json.
+	Format string `yaml:"format" toml:"format"`
+}
+
+type TraceConfig struct {
+	// Exporter selects where spans are exported: "otlp", "file", or nothing to
+	// disable tracing.
+	Exporter string `yaml:"exporter" toml:"exporter"`
+	// File is the file spans are written to with the "file" exporter.
+	File string `yaml:"file" toml:"file"`
+}
+
+// Default returns the configuration used for everything that is not set.
+func Default() *Config {
+	nodeID, _ := os.Hostname()
 	return &Config{
-		Token: token,
-		Addr:  addr,
+		Addr: ":8080",
+		Auth: AuthConfig{AllowQueryToken: true},
+		Limits: LimitsConfig{
+			MaxMessageSize:  512,
+			SendBufferSize:  256,
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			MaxViolations:   10,
+			Display: RateConfig{
+				MessagesPerSecond: 50,
+				MessageBurst:      100,
+				BytesPerSecond:    64 << 10,
+				ByteBurst:         128 << 10,
+			},
+			Controller: RateConfig{
+				MessagesPerSecond: 20,
+				MessageBurst:      40,
+				BytesPerSecond:    32 << 10,
+				ByteBurst:         64 << 10,
+			},
+		},
+		Timeouts: TimeoutsConfig{
+			Write:                 10 * time.Second,
+			Pong:                  60 * time.Second,
+			Auth:                  5 * time.Second,
+			Command:               10 * time.Second,
+			DisplayResumeGrace:    10 * time.Second,
+			ControllerResumeGrace: 30 * time.Second,
+			RestoreGrace:          time.Minute,
+			Shutdown:              10 * time.Second,
+			ReconnectDelay:        time.Second,
+		},
+		Compression: CompressionConfig{
+			Level:     flate.BestSpeed,
+			Threshold: 512,
+		},
+		Federation: FederationConfig{NodeID: nodeID},
+		Log:        LogConfig{Level: "info", Format: "text"},
+		Trace:      TraceConfig{File: "traces.jsonl"},
+	}
+}
+
+// Load builds the configuration from, in increasing order of precedence, the
+// defaults, the config file, CONTROLY_* environment variables and flags. It
+// also reports whether --print-config was given.
+func Load(args []string) (*Config, bool, error) {
+	cfg := Default()
+	fs := flag.NewFlagSet("controly", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("CONTROLY_CONFIG"), "config file (.yaml, .yml or .toml) [CONTROLY_CONFIG]")
+	printConfig := fs.Bool("print-config", false, "print the effective configuration and exit")
+	cfg.bindFlags(fs)
+
+	// The first pass only finds the config file. The flags are parsed again
+	// once the file and the environment are applied, so that they win.
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
+	if *path != "" {
+		if err := cfg.loadFile(*path); err != nil {
+			return nil, false, err
+		}
+	}
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+		env := envName(f.Name)
+		if v := os.Getenv(env); v != "" {
+			if err := f.Value.Set(v); err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s %q: %w", env, v, err))
+			}
+		}
+	})
+	if err := errors.Join(errs...); err != nil {
+		return nil, false, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, false, err
+	}
+	return cfg, *printConfig, nil
+}
+
+// bindFlags defines a flag for every setting. Each flag can also be set with
+// the environment variable named after it, e.g. CONTROLY_MAX_MESSAGE_SIZE.
+func (c *Config) bindFlags(fs *flag.FlagSet) {
+	str := func(p *string, name, usage string) { fs.StringVar(p, name, *p, usage+" ["+envName(name)+"]") }
+	boolean := func(p *bool, name, usage string) { fs.BoolVar(p, name, *p, usage+" ["+envName(name)+"]") }
+	integer := func(p *int, name, usage string) { fs.IntVar(p, name, *p, usage+" ["+envName(name)+"]") }
+	integer64 := func(p *int64, name, usage string) { fs.Int64Var(p, name, *p, usage+" ["+envName(name)+"]") }
+	duration := func(p *time.Duration, name, usage string) {
+		fs.DurationVar(p, name, *p, usage+" ["+envName(name)+"]")
+	}
+	list := func(p *[]string, name, usage string) { fs.Var((*listValue)(p), name, usage+" ["+envName(name)+"]") }
+
+	str(&c.Addr, "addr", "address to listen on")
+	boolean(&c.OpenRelay, "open-relay", "forward commands without subscription checks")
+	str(&c.Auth.Token, "token", "token displays must provide to connect")
+	str(&c.Auth.JWTSecret, "jwt-secret", "secret verifying HS256 client tokens")
+	str(&c.Auth.JWTPublicKey, "jwt-public-key", "Ed25519 public key file verifying EdDSA client tokens")
+	boolean(&c.Auth.AllowQueryToken, "allow-query-token", "accept tokens in the query string (deprecated)")
+	list(&c.Admin.APIKeys, "admin-api-keys", "comma-separated API keys for the REST API and the inspector")
+	str(&c.Admin.Addr, "admin-addr", "separate address to serve the REST API, the inspector, federation and metrics on")
+	list(&c.Origins.Allowed, "allowed-origins", "comma-separated origins WebSocket connections are accepted from")
+	list(&c.Origins.Display, "display-origins", "comma-separated origins displays may connect from")
+	list(&c.Origins.Controller, "controller-origins", "comma-separated origins controllers may connect from")
+	list(&c.Origins.Inspector, "inspector-origins", "comma-separated origins inspectors may connect from")
+	list(&c.Origins.API, "api-origins", "comma-separated origins allowed to call the REST API")
+	str(&c.TLS.CertFile, "tls-cert", "TLS certificate file")
+	str(&c.TLS.KeyFile, "tls-key", "TLS private key file")
+	str(&c.TLS.ClientCA, "tls-client-ca", "CA file client certificates are verified against")
+	str(&c.TLS.ClientAuth, "tls-client-auth", "client certificates: optional or require")
+	str(&c.TLS.RedirectAddr, "tls-redirect-addr", "address to redirect plain HTTP to HTTPS on")
+	integer64(&c.Limits.MaxMessageSize, "max-message-size", "largest message in bytes a client may send")
+	integer(&c.Limits.SendBufferSize, "send-buffer-size", "messages queued per client before dropping")
+	integer(&c.Limits.ReadBufferSize, "read-buffer-size", "WebSocket read buffer size in bytes")
+	integer(&c.Limits.WriteBufferSize, "write-buffer-size", "WebSocket write buffer size in bytes")
+	integer(&c.Limits.MaxClients, "max-clients", "most clients connected at once, 0 for no cap")
+	integer(&c.Limits.MaxConnectionsPerIP, "max-connections-per-ip", "most connections from one IP address, 0 for no cap")
+	integer(&c.Limits.MaxViolations, "max-violations", "messages over the rate limit a client may send before it is disconnected")
+	for _, t := range []struct {
+		name string
+		rate *RateConfig
+	}{{"display", &c.Limits.Display}, {"controller", &c.Limits.Controller}} {
+		integer(&t.rate.MessagesPerSecond, t.name+"-messages-per-second", "messages per second a "+t.name+" may send, 0 for no limit")
+		integer(&t.rate.MessageBurst, t.name+"-message-burst", "messages a "+t.name+" may send in a burst")
+		integer(&t.rate.BytesPerSecond, t.name+"-bytes-per-second", "bytes per second a "+t.name+" may send, 0 for no limit")
+		integer(&t.rate.ByteBurst, t.name+"-byte-burst", "bytes a "+t.name+" may send in a burst")
+	}
+	duration(&c.Timeouts.Write, "write-timeout", "time allowed for a write to a client")
+	duration(&c.Timeouts.Pong, "pong-timeout", "time allowed for a client to answer a ping")
+	duration(&c.Timeouts.Auth, "auth-timeout", "time a client has to send an auth message")
+	duration(&c.Timeouts.Command, "command-timeout", "time a display has to answer a command, 0 to disable")
+	duration(&c.Timeouts.DisplayResumeGrace, "display-resume-grace", "time a disconnected display may reconnect in")
+	duration(&c.Timeouts.ControllerResumeGrace, "controller-resume-grace", "time a disconnected controller may resume its session in")
+	duration(&c.Timeouts.RestoreGrace, "restore-grace", "time restored sessions wait for their clients after a restart")
+	duration(&c.Timeouts.Shutdown, "shutdown-timeout", "time a shutdown waits for connections to drain")
+	duration(&c.Timeouts.ReconnectDelay, "reconnect-delay", "time clients wait before reconnecting after a shutdown")
+	boolean(&c.Compression.Enabled, "compression", "enable permessage-deflate compression")
+	integer(&c.Compression.Level, "compression-level", "flate compression level, from -2 to 9")
+	integer(&c.Compression.Threshold, "compression-threshold", "size in bytes below which messages are not compressed")
+	str(&c.Federation.NodeID, "node-id", "ID of this node among federated nodes")
+	list(&c.Federation.Peers, "peers", "comma-separated federation endpoints of the other nodes")
+	str(&c.Federation.Secret, "federation-secret", "secret authenticating links between nodes")
+	str(&c.Federation.CAFile, "federation-ca", "CA file wss:// peers are verified against")
+	str(&c.Federation.CertFile, "federation-cert", "client certificate file presented to peers")
+	str(&c.Federation.KeyFile, "federation-key", "client certificate key file presented to peers")
+	str(&c.Store.Path, "store-path", "database file sessions are persisted to")
+	str(&c.Log.Level, "log-level", "log level: debug, info, warn or error")
+	str(&c.Log.Format, "log-format", "log format: text or json")
+	str(&c.Trace.Exporter, "trace-exporter", "span exporter: otlp or file")
+	str(&c.Trace.File, "trace-file", "file spans are written to by the file exporter")
+}
+
+// envName returns the environment variable for a flag.
+func envName(flagName string) string {
+	return "CONTROLY_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadFile reads a YAML or TOML config file over c. Unknown keys are errors.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil && err != io.EOF {
+			return fmt.Errorf("parsing config file %s: %w", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(data), c)
+		if err != nil {
+			return fmt.Errorf("parsing config file %s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("parsing config file %s: unknown key %s", path, undecoded[0])
+		}
+	default:
+		return fmt.Errorf("config file %s must end in .yaml, .yml or .toml", path)
+	}
+	return nil
+}
+
+// Validate reports every invalid setting.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Addr != "", "addr must not be empty")
+	check(c.TLS.CertFile == "" || c.TLS.KeyFile != "", "tls.key_file must be set with tls.cert_file")
+	check(c.TLS.KeyFile == "" || c.TLS.CertFile != "", "tls.cert_file must be set with tls.key_file")
+	check(c.TLS.ClientCA == "" || c.TLS.CertFile != "", "tls.client_ca requires tls.cert_file")
+	check(c.TLS.ClientAuth == "" || c.TLS.ClientAuth == "optional" || c.TLS.ClientAuth == "require",
+		"tls.client_auth %q must be optional, require or empty", c.TLS.ClientAuth)
+	check(c.TLS.ClientAuth == "" || c.TLS.ClientCA != "", "tls.client_auth requires tls.client_ca")
+	check(c.TLS.RedirectAddr == "" || c.TLS.CertFile != "", "tls.redirect_addr requires tls.cert_file")
+	for _, key := range c.Admin.APIKeys {
+		check(key != "", "admin.api_keys must not contain empty keys")
+	}
+	check(c.Admin.Addr == "" || c.Admin.Addr != c.Addr, "admin.addr must differ from addr")
+	for _, l := range []struct {
+		name    string
+		origins []string
+	}{
+		{"allowed", c.Origins.Allowed},
+		{"display", c.Origins.Display},
+		{"controller", c.Origins.Controller},
+		{"inspector", c.Origins.Inspector},
+		{"api", c.Origins.API},
+	} {
+		_, err := origin.New(l.origins)
+		check(err == nil, "origins.%s: %v", l.name, err)
+	}
+
+	check(c.Limits.MaxMessageSize > 0, "limits.max_message_size must be positive")
+	check(c.Limits.SendBufferSize > 0, "limits.send_buffer_size must be positive")
+	check(c.Limits.ReadBufferSize > 0, "limits.read_buffer_size must be positive")
+	check(c.Limits.WriteBufferSize > 0, "limits.write_buffer_size must be positive")
+	check(c.Limits.MaxClients >= 0, "limits.max_clients must not be negative")
+	check(c.Limits.MaxConnectionsPerIP >= 0, "limits.max_connections_per_ip must not be negative")
+	check(c.Limits.MaxViolations >= 0, "limits.max_violations must not be negative")
+	for _, t := range []struct {
+		name string
+		rate RateConfig
+	}{{"display", c.Limits.Display}, {"controller", c.Limits.Controller}} {
+		check(t.rate.MessagesPerSecond >= 0, "limits.%s.messages_per_second must not be negative", t.name)
+		check(t.rate.MessagesPerSecond == 0 || t.rate.MessageBurst > 0,
+			"limits.%s.message_burst must be positive when messages_per_second is set", t.name)
+		check(t.rate.BytesPerSecond >= 0, "limits.%s.bytes_per_second must not be negative", t.name)
+		check(t.rate.BytesPerSecond == 0 || int64(t.rate.ByteBurst) >= c.Limits.MaxMessageSize,
+			"limits.%s.byte_burst must be at least limits.max_message_size when bytes_per_second is set", t.name)
+	}
+
+	check(c.Timeouts.Write > 0, "timeouts.write must be positive")
+	check(c.Timeouts.Pong > 0, "timeouts.pong must be positive")
+	check(c.Timeouts.Auth > 0, "timeouts.auth must be positive")
+	check(c.Timeouts.Command >= 0, "timeouts.command must not be negative")
+	check(c.Timeouts.DisplayResumeGrace >= 0, "timeouts.display_resume_grace must not be negative")
+	check(c.Timeouts.ControllerResumeGrace >= 0, "timeouts.controller_resume_grace must not be negative")
+	check(c.Timeouts.RestoreGrace >= 0, "timeouts.restore_grace must not be negative")
+	check(c.Timeouts.Shutdown > 0, "timeouts.shutdown must be positive")
+	check(c.Timeouts.ReconnectDelay >= 0, "timeouts.reconnect_delay must not be negative")
+
+	check(c.Compression.Level >= flate.HuffmanOnly && c.Compression.Level <= flate.BestCompression,
+		"compression.level must be from %d to %d", flate.HuffmanOnly, flate.BestCompression)
+	check(c.Compression.Threshold >= 0, "compression.threshold must not be negative")
+
+	if len(c.Federation.Peers) > 0 {
+		check(c.Federation.NodeID != "", "federation.node_id must be set when peers are")
+		check(c.Federation.Secret != "", "federation.secret must be set when peers are")
+	}
+	check(c.Federation.CertFile == "" || c.Federation.KeyFile != "", "federation.key_file must be set with federation.cert_file")
+	check(c.Federation.KeyFile == "" || c.Federation.CertFile != "", "federation.cert_file must be set with federation.key_file")
+	for _, peer := range c.Federation.Peers {
+		u, err := url.Parse(peer)
+		check(err == nil && (u.Scheme == "ws" || u.Scheme == "wss") && u.Host != "",
+			"federation.peers: %q is not a ws:// or wss:// URL", peer)
+	}
+
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.Log.Level)) == nil, "log.level %q must be debug, info, warn or error", c.Log.Level)
+	check(c.Log.Format == "text" || c.Log.Format == "json", "log.format %q must be text or json", c.Log.Format)
+	check(c.Trace.Exporter == "" || c.Trace.Exporter == "otlp" || c.Trace.Exporter == "file",
+		"trace.exporter %q must be otlp, file or empty", c.Trace.Exporter)
+	check(c.Trace.Exporter != "file" || c.Trace.File != "", "trace.file must be set for the file exporter")
+
+	return errors.Join(errs...)
+}
+
+// Print writes the configuration as YAML, with secrets redacted.
+func (c *Config) Print(w io.Writer) error {
+	redacted := *c
+	redact := func(s *string) {
+		if *s != "" {
+			*s = "REDACTED"
+		}
+	}
+	redact(&redacted.Auth.Token)
+	redact(&redacted.Auth.JWTSecret)
+	redact(&redacted.Federation.Secret)
+	redacted.Admin.APIKeys = slices.Clone(c.Admin.APIKeys)
+	for i := range redacted.Admin.APIKeys {
+		redact(&redacted.Admin.APIKeys[i])
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&redacted); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// LogSummary logs the features the configuration enables.
+func (c *Config) LogSummary() {
+	if c.Auth.Token != "" {
+		slog.Info("Server token is set. Displays must provide a valid token to connect.")
+	} else {
+		slog.Info("Server token is not set. Displays can connect without a token.")
+	}
+	if c.Auth.JWTSecret != "" || c.Auth.JWTPublicKey != "" {
+		slog.Info("JWT authentication is enabled. Every client must provide a valid token to connect.")
+	}
+	if len(c.Admin.APIKeys) == 0 && c.Admin.Addr == "" {
+		slog.Warn("No admin API keys are set. Anyone can use the REST API and the inspector.")
+	}
+	if c.Admin.Addr != "" {
+		slog.Info("Serving the REST API and the inspector on a separate address", "addr", c.Admin.Addr)
+	}
+	if c.OpenRelay {
+		slog.Info("Open relay mode is enabled. Commands are forwarded without subscription checks.")
+	}
+	if c.Compression.Enabled {
+		slog.Info("permessage-deflate compression is enabled", "level", c.Compression.Level)
+	}
+	if len(c.Federation.Peers) > 0 {
+		slog.Info("Federation is enabled", "node", c.Federation.NodeID, "peers", len(c.Federation.Peers))
+	}
+}
+
+// listValue is a flag.Value for comma-separated lists.
+type listValue []string
+
+func (l *listValue) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(s string) error {
+	*l = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
 	}
+	return nil
 }
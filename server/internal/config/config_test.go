@@ -0,0 +1,172 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFile writes a config file named name into a temporary directory.
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeFile(t, "controly.yaml", `
+addr: ":1001"
+log:
+  level: warn
+timeouts:
+  write: 5s
+origins:
+  allowed: ["https://file.test"]
+`)
+	tests := []struct {
+		name        string
+		env         map[string]string
+		args        []string
+		wantAddr    string
+		wantLevel   string
+		wantWrite   time.Duration
+		wantOrigins []string
+	}{
+		{
+			name:      "defaults",
+			wantAddr:  Default().Addr,
+			wantLevel: "info",
+			wantWrite: Default().Timeouts.Write,
+		},
+		{
+			name:        "file over defaults",
+			args:        []string{"--config", file},
+			wantAddr:    ":1001",
+			wantLevel:   "warn",
+			wantWrite:   5 * time.Second,
+			wantOrigins: []string{"https://file.test"},
+		},
+		{
+			name:        "file from the environment",
+			env:         map[string]string{"CONTROLY_CONFIG": file},
+			wantAddr:    ":1001",
+			wantLevel:   "warn",
+			wantWrite:   5 * time.Second,
+			wantOrigins: []string{"https://file.test"},
+		},
+		{
+			name:        "environment over file",
+			env:         map[string]string{"CONTROLY_ADDR": ":1002", "CONTROLY_ALLOWED_ORIGINS": "https://a.test, https://b.test"},
+			args:        []string{"--config", file},
+			wantAddr:    ":1002",
+			wantLevel:   "warn",
+			wantWrite:   5 * time.Second,
+			wantOrigins: []string{"https://a.test", "https://b.test"},
+		},
+		{
+			name:        "flags over environment",
+			env:         map[string]string{"CONTROLY_ADDR": ":1002", "CONTROLY_WRITE_TIMEOUT": "7s"},
+			args:        []string{"--config", file, "--addr", ":1003", "--log-level", "debug"},
+			wantAddr:    ":1003",
+			wantLevel:   "debug",
+			wantWrite:   7 * time.Second,
+			wantOrigins: []string{"https://file.test"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, _, err := Load(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Addr != tt.wantAddr {
+				t.Errorf("addr = %q, want %q", cfg.Addr, tt.wantAddr)
+			}
+			if cfg.Log.Level != tt.wantLevel {
+				t.Errorf("log.level = %q, want %q", cfg.Log.Level, tt.wantLevel)
+			}
+			if cfg.Timeouts.Write != tt.wantWrite {
+				t.Errorf("timeouts.write = %v, want %v", cfg.Timeouts.Write, tt.wantWrite)
+			}
+			if !slices.Equal(cfg.Origins.Allowed, tt.wantOrigins) {
+				t.Errorf("origins.allowed = %q, want %q", cfg.Origins.Allowed, tt.wantOrigins)
+			}
+		})
+	}
+}
+
+func TestLoadTOML(t *testing.T) {
+	file := writeFile(t, "controly.toml", `
+addr = ":1001"
+
+[timeouts]
+write = "5s"
+
+[limits.display]
+messages_per_second = 5
+message_burst = 10
+`)
+	cfg, _, err := Load([]string{"--config", file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != ":1001" || cfg.Timeouts.Write != 5*time.Second || cfg.Limits.Display.MessagesPerSecond != 5 {
+		t.Errorf("addr = %q, timeouts.write = %v, limits.display.messages_per_second = %d",
+			cfg.Addr, cfg.Timeouts.Write, cfg.Limits.Display.MessagesPerSecond)
+	}
+	// Settings the file leaves out keep their defaults.
+	if cfg.Limits.Display.BytesPerSecond != Default().Limits.Display.BytesPerSecond {
+		t.Errorf("limits.display.bytes_per_second = %d, want the default", cfg.Limits.Display.BytesPerSecond)
+	}
+}
+
+func TestLoadExampleConfig(t *testing.T) {
+	if _, _, err := Load([]string{"--config", "../../controly.example.yaml"}); err != nil {
+		t.Errorf("loading the example config: %v", err)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		file    string // Name and content, separated by a newline
+		args    []string
+		wantErr string
+	}{
+		{name: "unknown yaml key", file: "c.yaml\nadress: x", wantErr: "adress"},
+		{name: "unknown toml key", file: "c.toml\nadress = 'x'", wantErr: "unknown key adress"},
+		{name: "unsupported extension", file: "c.json\n{}", wantErr: "must end in"},
+		{name: "missing file", args: []string{"--config", "/nonexistent/controly.yaml"}, wantErr: "reading config file"},
+		{name: "invalid environment value", env: map[string]string{"CONTROLY_MAX_CLIENTS": "many"}, wantErr: "CONTROLY_MAX_CLIENTS"},
+		{name: "unknown flag", args: []string{"--no-such-flag"}, wantErr: "no-such-flag"},
+		{name: "invalid setting", args: []string{"--log-format", "xml"}, wantErr: "log.format"},
+		{name: "peers without secret", args: []string{"--peers", "ws://b.test/federation"}, wantErr: "federation.secret"},
+		{name: "federation certificate without key", args: []string{"--federation-cert", "node.pem"}, wantErr: "federation.key_file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			args := tt.args
+			if tt.file != "" {
+				name, content, _ := strings.Cut(tt.file, "\n")
+				args = append([]string{"--config", writeFile(t, name, content)}, args...)
+			}
+			_, _, err := Load(args)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Load() error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
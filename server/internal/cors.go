@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/simbafs/controly/server/internal/origin"
+)
+
+// CORS returns a middleware that lets pages on the allowed origins call the
+// wrapped handlers and answers their preflight requests. Requests from other
+// origins are rejected. Pages served by the relay itself are only trusted
+// while the list is empty. Routes must accept OPTIONS for preflight requests
+// to reach it.
+func CORS(allowed *origin.Allowlist) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Origin")
+			o := r.Header.Get("Origin")
+			sameHost := o != "" && origin.SameHost(o, r.Host)
+			if o != "" && !allowed.Allows(o) && !(sameHost && allowed.Empty()) {
+				rejectedOriginsTotal.WithLabelValues("api").Inc()
+				hotLog.Log(slog.Default(), slog.LevelWarn, "api_origin", "Rejected REST API request from a disallowed origin",
+					"origin", o, "remote_addr", r.RemoteAddr, "path", r.URL.Path)
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
+
+			crossOrigin := o != "" && !sameHost
+			if crossOrigin {
+				w.Header().Set("Access-Control-Allow-Origin", o)
+			}
+			// OPTIONS requests never reach the handlers, which do not check
+			// the method.
+			if r.Method == http.MethodOptions {
+				if crossOrigin {
+					w.Header().Set("Access-Control-Allow-Methods", "GET, DELETE")
+					w.Header().Set("Access-Control-Allow-Headers", "Authorization, X-API-Key")
+					w.Header().Set("Access-Control-Max-Age", "600")
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/simbafs/controly/server/internal/config"
+	"github.com/simbafs/controly/server/internal/origin"
+)
+
+func TestCORS(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name     string
+		patterns []string
+		origin   string
+		want     int
+	}{
+		{"no origin", []string{"https://app.test"}, "", http.StatusOK},
+		{"allowed", []string{"https://app.test"}, "https://app.test", http.StatusOK},
+		{"not allowed", []string{"https://app.test"}, "https://evil.test", http.StatusForbidden},
+		{"relay page without list", nil, "http://relay.test", http.StatusOK},
+		{"other page without list", nil, "https://evil.test", http.StatusForbidden},
+		{"relay host not on list", []string{"https://app.test"}, "http://relay.test", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, err := origin.New(tt.patterns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodGet, "http://relay.test/api/displays", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			CORS(allowed)(ok).ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	cfg := config.Default()
+	cfg.Origins.Allowed = []string{"https://app.test"}
+	cfg.Origins.Display = []string{"*"}
+	h := NewHub(cfg)
+
+	tests := []struct {
+		clientType, origin string
+		want               bool
+	}{
+		{"controller", "", true},
+		{"controller", "https://app.test", true},
+		{"controller", "https://evil.test", false},
+		{"controller", "http://relay.test", false},
+		{"display", "https://evil.test", true},
+		{"unknown", "http://relay.test", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://relay.test/ws", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := h.checkOrigin(r, tt.clientType); got != tt.want {
+			t.Errorf("checkOrigin(%s from %q) = %v, want %v", tt.clientType, tt.origin, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+)
+
+// CommandType defines the kind of control a command is rendered as.
+type CommandType string
+
+const (
+	CommandTypeButton   CommandType = "button"
+	CommandTypeText     CommandType = "text"
+	CommandTypeNumber   CommandType = "number"
+	CommandTypeSelect   CommandType = "select"
+	CommandTypeCheckbox CommandType = "checkbox"
+)
+
+// CommandOption is one of the choices of a select command.
+type CommandOption struct {
+	Label string          `json:"label"`
+	Value json.RawMessage `json:"value"`
+}
+
+// CommandDefinition is a single entry of a display's command.json.
+type CommandDefinition struct {
+	Name    string          `json:"name"`
+	Label   string          `json:"label"`
+	Type    CommandType     `json:"type"`
+	Default json.RawMessage `json:"default,omitempty"`
+
+	// text
+	Regex string `json:"regex,omitempty"`
+	// number
+	Min  *float64 `json:"min,omitempty"`
+	Max  *float64 `json:"max,omitempty"`
+	Step *float64 `json:"step,omitempty"`
+	// select
+	Options []CommandOption `json:"options,omitempty"`
+
+	regex *regexp.Regexp
+}
+
+// ParseCommandList parses the content of a command.json into command
+// definitions keyed by name.
+func ParseCommandList(data json.RawMessage) (map[string]*CommandDefinition, error) {
+	var defs []*CommandDefinition
+	if err := json.Unmarshal(data, &defs); err != nil {
+		return nil, NewError(ErrInvalidCommandJSON, "command list must be an array of commands: %v", err)
+	}
+
+	commands := make(map[string]*CommandDefinition, len(defs))
+	for i, def := range defs {
+		if def == nil || def.Name == "" {
+			return nil, NewError(ErrInvalidCommandJSON, "command #%d is missing a name", i)
+		}
+		if _, exists := commands[def.Name]; exists {
+			return nil, NewError(ErrInvalidCommandJSON, "duplicate command name: %s", def.Name)
+		}
+
+		switch def.Type {
+		case CommandTypeButton, CommandTypeNumber, CommandTypeCheckbox:
+		case CommandTypeText:
+			if def.Regex != "" {
+				// Like the HTML pattern attribute, the regex must match the whole value.
+				re, err := regexp.Compile("^(?:" + def.Regex + ")$")
+				if err != nil {
+					return nil, NewError(ErrInvalidCommandJSON, "command %s has an invalid regex: %v", def.Name, err)
+				}
+				def.regex = re
+			}
+		case CommandTypeSelect:
+			if len(def.Options) == 0 {
+				return nil, NewError(ErrInvalidCommandJSON, "select command %s has no options", def.Name)
+			}
+		default:
+			return nil, NewError(ErrInvalidCommandJSON, "command %s has unknown type: %q", def.Name, def.Type)
+		}
+		if def.Step != nil && *def.Step <= 0 {
+			return nil, NewError(ErrInvalidCommandJSON, "command %s must have a positive step", def.Name)
+		}
+
+		commands[def.Name] = def
+	}
+	return commands, nil
+}
+
+// ValidateArgs checks the argument of a command against its definition.
+// Commands other than buttons take a single argument, whatever its name: the
+// controller UI sends {"value": ...}, other clients may name it, e.g.
+// {"level": ...}.
+func (d *CommandDefinition) ValidateArgs(args map[string]json.RawMessage) error {
+	if d.Type == CommandTypeButton {
+		return nil
+	}
+
+	raw, ok := args["value"]
+	if !ok {
+		if len(args) != 1 {
+			return NewError(ErrInvalidCommandArgs, "command %s expects a single argument", d.Name)
+		}
+		for _, v := range args {
+			raw = v
+		}
+	}
+	if string(bytes.TrimSpace(raw)) == "null" {
+		// null would decode into any type without an error.
+		return NewError(ErrInvalidCommandArgs, "command %s argument must not be null", d.Name)
+	}
+
+	switch d.Type {
+	case CommandTypeText:
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return NewError(ErrInvalidCommandArgs, "command %s expects a string value", d.Name)
+		}
+		if d.regex != nil && !d.regex.MatchString(value) {
+			return NewError(ErrInvalidCommandArgs, "command %s value does not match %s", d.Name, d.Regex)
+		}
+	case CommandTypeNumber:
+		var value float64
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return NewError(ErrInvalidCommandArgs, "command %s expects a number value", d.Name)
+		}
+		if d.Min != nil && value < *d.Min {
+			return NewError(ErrInvalidCommandArgs, "command %s value %v is less than %v", d.Name, value, *d.Min)
+		}
+		if d.Max != nil && value > *d.Max {
+			return NewError(ErrInvalidCommandArgs, "command %s value %v is greater than %v", d.Name, value, *d.Max)
+		}
+		if d.Step != nil {
+			// Steps are counted from min, as with the HTML number input.
+			base := 0.0
+			if d.Min != nil {
+				base = *d.Min
+			}
+			n := (value - base) / *d.Step
+			if math.Abs(n-math.Round(n)) > 1e-9 {
+				return NewError(ErrInvalidCommandArgs, "command %s value %v is not a multiple of step %v", d.Name, value, *d.Step)
+			}
+		}
+	case CommandTypeSelect:
+		value, err := scalarString(raw)
+		if err != nil {
+			return NewError(ErrInvalidCommandArgs, "command %s expects a string or number value", d.Name)
+		}
+		for _, opt := range d.Options {
+			if optValue, err := scalarString(opt.Value); err == nil && optValue == value {
+				return nil
+			}
+		}
+		return NewError(ErrInvalidCommandArgs, "command %s has no option %q", d.Name, value)
+	case CommandTypeCheckbox:
+		var value bool
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return NewError(ErrInvalidCommandArgs, "command %s expects a boolean value", d.Name)
+		}
+	}
+	return nil
+}
+
+// scalarString returns the string form of a JSON string or number, so that
+// select values compare equal regardless of how the controller encoded them.
+func scalarString(raw json.RawMessage) (string, error) {
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", err
+	}
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return fmt.Sprint(v), nil
+	default:
+		return "", fmt.Errorf("unsupported value type %T", v)
+	}
+}
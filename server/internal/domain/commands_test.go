@@ -0,0 +1,119 @@
+package domain
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParseCommandList(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{"valid", `[{"name":"a","type":"button"},{"name":"b","type":"text","regex":"[a-z]+"}]`, false},
+		{"not an array", `{"name":"a","type":"button"}`, true},
+		{"missing name", `[{"type":"button"}]`, true},
+		{"null entry", `[null]`, true},
+		{"duplicate name", `[{"name":"a","type":"button"},{"name":"a","type":"button"}]`, true},
+		{"unknown type", `[{"name":"a","type":"slider"}]`, true},
+		{"invalid regex", `[{"name":"a","type":"text","regex":"("}]`, true},
+		{"select without options", `[{"name":"a","type":"select"}]`, true},
+		{"zero step", `[{"name":"a","type":"number","step":0}]`, true},
+		{"negative step", `[{"name":"a","type":"number","step":-1}]`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseCommandList(json.RawMessage(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseCommandList() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var e *Error
+			if err != nil && (!errors.As(err, &e) || e.Code != ErrInvalidCommandJSON) {
+				t.Errorf("ParseCommandList() error = %v, want code %d", err, ErrInvalidCommandJSON)
+			}
+		})
+	}
+}
+
+func TestValidateArgs(t *testing.T) {
+	commands, err := ParseCommandList(json.RawMessage(`[
+		{"name":"go","type":"button"},
+		{"name":"code","type":"text","regex":"[a-z]+|[0-9]+"},
+		{"name":"free","type":"text"},
+		{"name":"level","type":"number","min":1,"max":10,"step":2},
+		{"name":"any","type":"number"},
+		{"name":"fine","type":"number","step":0.1},
+		{"name":"mode","type":"select","options":[{"label":"One","value":1},{"label":"Two","value":"two"}]},
+		{"name":"on","type":"checkbox"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		command string
+		args    string
+		wantErr bool
+	}{
+		{"go", `{}`, false},
+		{"go", `{"anything":[1,2]}`, false},
+
+		{"code", `{"value":"abc"}`, false},
+		{"code", `{"value":"123"}`, false},
+		// The regex is anchored around the whole alternation.
+		{"code", `{"value":"abc123"}`, true},
+		{"code", `{"value":"ABC"}`, true},
+		{"code", `{"value":5}`, true},
+		{"free", `{"value":""}`, false},
+		{"free", `{"value":null}`, true},
+
+		// Steps count from min: 1, 3, 5, ...
+		{"level", `{"value":1}`, false},
+		{"level", `{"value":9}`, false},
+		{"level", `{"value":2}`, true},
+		{"level", `{"value":0}`, true},
+		{"level", `{"value":11}`, true},
+		{"level", `{"value":"3"}`, true},
+		{"any", `{"value":-1.5}`, false},
+		{"any", `{"value":null}`, true},
+		{"fine", `{"value":0.3}`, false},
+		{"fine", `{"value":0.35}`, true},
+
+		// Numbers and strings match options of either encoding.
+		{"mode", `{"value":1}`, false},
+		{"mode", `{"value":"1"}`, false},
+		{"mode", `{"value":"two"}`, false},
+		{"mode", `{"value":2}`, true},
+		{"mode", `{"value":true}`, true},
+		{"mode", `{"value":null}`, true},
+
+		{"on", `{"value":true}`, false},
+		{"on", `{"value":"true"}`, true},
+		{"on", `{"value":null}`, true},
+
+		// The single argument may have any name.
+		{"level", `{"level":5}`, false},
+		{"level", `{"level":4}`, true},
+		{"level", `{}`, true},
+		{"level", `{"a":1,"b":3}`, true},
+		{"level", `{"value":3,"other":"x"}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command+" "+tt.args, func(t *testing.T) {
+			var args map[string]json.RawMessage
+			if err := json.Unmarshal([]byte(tt.args), &args); err != nil {
+				t.Fatal(err)
+			}
+			err := commands[tt.command].ValidateArgs(args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var e *Error
+			if err != nil && (!errors.As(err, &e) || e.Code != ErrInvalidCommandArgs) {
+				t.Errorf("ValidateArgs() error = %v, want code %d", err, ErrInvalidCommandArgs)
+			}
+		})
+	}
+}
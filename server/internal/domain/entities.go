@@ -33,41 +33,121 @@ func (ct ClientType) String() string {
 // Display represents a connected Display device.
 type Display struct {
 	ID          string
-	CommandList json.RawMessage // Store raw command.json content
-	Subscribers map[string]bool // Map of Controller IDs subscribed to this Display
-	Mu          sync.Mutex      // Mutex to protect access to Subscribers
+	ResumeToken string                        // Secret that lets a reconnecting display reattach
+	CommandList json.RawMessage               // Store raw command.json content
+	Commands    map[string]*CommandDefinition // Parsed CommandList, keyed by command name
+	Subscribers map[string]bool               // Map of Controller IDs subscribed to this Display
+	Status      json.RawMessage               // Last status sent by the Display, nil until the first one
+	Mu          sync.Mutex                    // Mutex to protect access to ResumeToken, CommandList, Commands, Subscribers and Status
 }
 
-func NewDisplay(id string, commandList json.RawMessage) *Display {
+func NewDisplay(id string, commandList json.RawMessage, commands map[string]*CommandDefinition, resumeToken string) *Display {
 	return &Display{
 		ID:          id,
+		ResumeToken: resumeToken,
 		CommandList: commandList,
+		Commands:    commands,
 		Subscribers: make(map[string]bool),
 	}
 }
 
-func (d *Display) RemoveSubscriber(controllerID string) {
+// SetStatus records the latest status and returns the IDs of the current subscribers.
+func (d *Display) SetStatus(status json.RawMessage) []string {
+	d.Mu.Lock()
+	defer d.Mu.Unlock()
+	d.Status = status
+	subscribers := make([]string, 0, len(d.Subscribers))
+	for id := range d.Subscribers {
+		subscribers = append(subscribers, id)
+	}
+	return subscribers
+}
+
+// ApplyStatusPatch merges a JSON Merge Patch into the latest status. It returns
+// the resulting status and the IDs of the current subscribers.
+func (d *Display) ApplyStatusPatch(patch json.RawMessage) (json.RawMessage, []string, error) {
+	d.Mu.Lock()
+	defer d.Mu.Unlock()
+	status, err := MergePatch(d.Status, patch)
+	if err != nil {
+		return nil, nil, err
+	}
+	d.Status = status
+	subscribers := make([]string, 0, len(d.Subscribers))
+	for id := range d.Subscribers {
+		subscribers = append(subscribers, id)
+	}
+	return status, subscribers, nil
+}
+
+// LastStatus returns the latest status, or nil if the Display has not sent one yet.
+func (d *Display) LastStatus() json.RawMessage {
+	d.Mu.Lock()
+	defer d.Mu.Unlock()
+	return d.Status
+}
+
+// LastCommandList returns the raw command list the Display declared.
+func (d *Display) LastCommandList() json.RawMessage {
+	d.Mu.Lock()
+	defer d.Mu.Unlock()
+	return d.CommandList
+}
+
+// ValidateCommand checks that the command is declared in the display's
+// command list and that its arguments satisfy the declaration.
+func (d *Display) ValidateCommand(cmd *CommandPayload) error {
+	d.Mu.Lock()
+	def, ok := d.Commands[cmd.Name]
+	d.Mu.Unlock()
+	if !ok {
+		return NewError(ErrUnknownCommand, "display %s has no command %s", d.ID, cmd.Name)
+	}
+	return def.ValidateArgs(cmd.Args)
+}
+
+// RemoveSubscriber unsubscribes a Controller and returns how many subscribers
+// remain.
+func (d *Display) RemoveSubscriber(controllerID string) int {
 	d.Mu.Lock()
 	defer d.Mu.Unlock()
 	delete(d.Subscribers, controllerID)
+	return len(d.Subscribers)
 }
 
 // Controller represents a connected Controller client.
 type Controller struct {
 	ID            string
+	ResumeToken   string          // Secret that lets a reconnecting client take over this session
 	Subscriptions map[string]bool // Map of Display IDs this Controller is subscribed to
 	WaitingFor    map[string]bool // Map of Display IDs this Controller is waiting for
-	Mu            sync.Mutex      // Mutex to protect access to Subscriptions and WaitingFor
+	StatusPatches bool            // Whether status updates are sent as 'status_patch' instead of full snapshots
+	Mu            sync.Mutex      // Mutex to protect access to Subscriptions, WaitingFor and StatusPatches
 }
 
-func NewController(id string) *Controller {
+func NewController(id, resumeToken string) *Controller {
 	return &Controller{
 		ID:            id,
+		ResumeToken:   resumeToken,
 		Subscriptions: make(map[string]bool),
 		WaitingFor:    make(map[string]bool),
 	}
 }
 
+// SetStatusPatches sets whether the Controller receives 'status_patch' messages.
+func (c *Controller) SetStatusPatches(enabled bool) {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	c.StatusPatches = enabled
+}
+
+// WantsStatusPatches reports whether the Controller receives 'status_patch' messages.
+func (c *Controller) WantsStatusPatches() bool {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return c.StatusPatches
+}
+
 // SetWaitingList clears the existing waiting list and sets it to the new list of display IDs.
 // It returns the final list of display IDs that were actually added to the waiting list.
 func (c *Controller) SetWaitingList(displayIDs []string, isDisplayOnline func(string) bool) []string {
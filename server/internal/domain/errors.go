@@ -1,10 +1,13 @@
 package domain
 
+import "fmt"
+
 // Error Codes
 const (
 	// Connection Errors (1xxx)
 	ErrInvalidQueryParams = 1001
 	ErrInvalidClientType  = 1002
+	ErrInternalServer     = 1003
 
 	// Display Registration Errors (2xxx)
 	ErrCommandURLUnreachable = 2001
@@ -17,10 +20,39 @@ const (
 	ErrTargetDisplayAlreadyControlled = 3002
 	ErrControllerIDConflict           = 3003
 	ErrNotSubscribedToDisplay         = 3004
+	ErrPermissionDenied               = 3005
 
 	// Communication Errors (4xxx)
 	ErrInvalidMessageFormat = 4001
 	ErrUnknownCommand       = 4002
 	ErrInvalidCommandArgs   = 4003
 	ErrInvalidCommandFormat = 4004
+	ErrRateLimited          = 4005
 )
+
+// Error is an error that carries one of the error codes above, so it can be
+// reported to the client as an 'error' message.
+type Error struct {
+	Code    int
+	Message string
+}
+
+// NewError creates a new Error with the given code and formatted message.
+func NewError(code int, format string, args ...any) *Error {
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// Payload returns the ErrorPayload sent to the client for this error.
+func (e *Error) Payload() ErrorPayload {
+	return ErrorPayload{
+		Code:    e.Code,
+		Message: e.Message,
+	}
+}
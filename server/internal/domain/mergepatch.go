@@ -0,0 +1,54 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// MergePatch applies a JSON Merge Patch (RFC 7386) to target and returns the
+// result. An empty or non-object target is treated as an empty object when the
+// patch is an object.
+func MergePatch(target, patch json.RawMessage) (json.RawMessage, error) {
+	p, err := decodeJSON(patch)
+	if err != nil {
+		return nil, err
+	}
+	var t any
+	if len(target) > 0 {
+		if t, err = decodeJSON(target); err != nil {
+			t = nil
+		}
+	}
+	return json.Marshal(mergePatch(t, p))
+}
+
+func mergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = make(map[string]any, len(p))
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// decodeJSON decodes data keeping numbers as json.Number, so that values pass
+// through a patch without losing precision.
+func decodeJSON(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
@@ -0,0 +1,50 @@
+package domain
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+	// Cases from RFC 7386, appendix A, and edge cases of the targets the hub keeps.
+	tests := []struct {
+		target, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+		// No status yet, or one that is not valid JSON.
+		{``, `{"a":1}`, `{"a":1}`},
+		{`not json`, `{"a":1}`, `{"a":1}`},
+		// Numbers keep their precision.
+		{`{"n":1}`, `{"big":12345678901234567890}`, `{"big":12345678901234567890,"n":1}`},
+	}
+	for _, tt := range tests {
+		got, err := MergePatch(json.RawMessage(tt.target), json.RawMessage(tt.patch))
+		if err != nil {
+			t.Errorf("MergePatch(%s, %s) error: %v", tt.target, tt.patch, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("MergePatch(%s, %s) = %s, want %s", tt.target, tt.patch, got, tt.want)
+		}
+	}
+}
+
+func TestMergePatchInvalidPatch(t *testing.T) {
+	if _, err := MergePatch(json.RawMessage(`{}`), json.RawMessage(`{"a":`)); err == nil {
+		t.Error("MergePatch with an invalid patch succeeded")
+	}
+}
@@ -6,14 +6,42 @@ import "encoding/json"
 type IncomingMessage struct {
 	Type    string          `json:"type"`
 	To      string          `json:"to,omitempty"` // e.g., for 'command' messages
+	ID      string          `json:"id,omitempty"` // Correlation ID of a 'command' and its 'command_result'
 	Payload json.RawMessage `json:"payload"`
+	Trace   TraceContext    `json:"trace,omitempty"`
 }
 
 // OutgoingMessage represents a message sent from the server.
 type OutgoingMessage struct {
 	Type    string          `json:"type"`
 	From    string          `json:"from,omitempty"` // Source (e.g., a display ID, or "server")
+	ID      string          `json:"id,omitempty"`   // Correlation ID of a 'command' and its 'command_result'
 	Payload json.RawMessage `json:"payload"`
+	Trace   TraceContext    `json:"trace,omitempty"`
+}
+
+// TraceContext carries W3C trace context fields, such as "traceparent", so
+// that a trace can continue across the relay.
+type TraceContext map[string]string
+
+// CommandPayload represents the payload of a 'command' message.
+type CommandPayload struct {
+	Name string                     `json:"name"`
+	Args map[string]json.RawMessage `json:"args,omitempty"`
+}
+
+// Command result statuses.
+const (
+	CommandResultSuccess = "success"
+	CommandResultError   = "error"
+	CommandResultTimeout = "timeout"
+)
+
+// CommandResultPayload represents the payload of a 'command_result' message.
+type CommandResultPayload struct {
+	Status string          `json:"status"`           // One of the CommandResult* statuses
+	Result json.RawMessage `json:"result,omitempty"` // Optional return value of the command
+	Error  string          `json:"error,omitempty"`  // Error description when Status is not success
 }
 
 // ErrorPayload represents the payload for an error message
@@ -37,6 +65,18 @@ type DisplayDisconnectedPayload struct {
 	DisplayID string `json:"display_id"`
 }
 
+// ServerShutdownPayload is the payload of a 'server_shutdown' message, sent
+// before the server closes all connections.
+type ServerShutdownPayload struct {
+	ReconnectAfter int64 `json:"reconnect_after_ms"` // How long clients should wait before reconnecting
+}
+
+// AuthPayload is the payload of an 'auth' message, which a client may send as
+// its first message instead of passing its token in the request.
+type AuthPayload struct {
+	Token string `json:"token"`
+}
+
 // InspectionMessage is the format for messages sent to the /ws/inspect endpoint.
 type InspectionMessage struct {
 	Source          string          `json:"source"`
@@ -46,5 +86,7 @@ type InspectionMessage struct {
 }
 
 type SetIDPayload struct {
-	ID string `json:"id"` // The ID to set for the client
+	ID          string `json:"id"`                     // The ID to set for the client
+	ResumeToken string `json:"resume_token,omitempty"` // Token to resume the session after reconnecting
+	Resumed     bool   `json:"resumed,omitempty"`      // Whether an existing session was resumed
 }
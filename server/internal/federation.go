@@ -0,0 +1,207 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+
+	"github.com/simbafs/controly/server/internal/domain"
+	"github.com/simbafs/controly/server/internal/federation"
+)
+
+// UseBroker joins the hub to other relay nodes through b. It must be called
+// before b is started.
+func (h *Hub) UseBroker(b federation.Broker) {
+	h.broker = b
+}
+
+// federate sends env to another node, if the hub is federated.
+func (h *Hub) federate(node string, env *federation.Envelope) {
+	if h.broker != nil {
+		h.broker.Send(node, env)
+	}
+}
+
+// announce sends env to every other node, if the hub is federated.
+func (h *Hub) announce(env *federation.Envelope) {
+	if h.broker != nil {
+		h.broker.Broadcast(env)
+	}
+}
+
+// remoteDisplayNode returns the node a display is registered on, if that is
+// not this node.
+func (h *Hub) remoteDisplayNode(displayID string) (string, bool) {
+	node, ok := h.remoteDisplays.Load(displayID)
+	if !ok {
+		return "", false
+	}
+	return node.(string), true
+}
+
+// isDisplayOnline reports whether a display is registered on this or another node.
+func (h *Hub) isDisplayOnline(displayID string) bool {
+	if _, ok := h.displayEntities.Load(displayID); ok {
+		return true
+	}
+	_, ok := h.remoteDisplays.Load(displayID)
+	return ok
+}
+
+// PeerUp tells a newly linked node which displays are registered here.
+func (h *Hub) PeerUp(node string) {
+	displayIDs := []string{}
+	h.displayEntities.Range(func(key, value any) bool {
+		displayIDs = append(displayIDs, key.(string))
+		return true
+	})
+	h.federate(node, &federation.Envelope{Type: federation.TypeDisplays, DisplayIDs: displayIDs})
+}
+
+// PeerDown treats every display of an unreachable node as disconnected and
+// drops its controllers from the local displays.
+func (h *Hub) PeerDown(node string) {
+	h.remoteDisplays.Range(func(key, value any) bool {
+		if value.(string) == node && h.remoteDisplays.CompareAndDelete(key, value) {
+			h.handleDisplayDisconnection(key.(string))
+		}
+		return true
+	})
+	h.remoteControllers.Range(func(key, value any) bool {
+		if value.(string) == node && h.remoteControllers.CompareAndDelete(key, value) {
+			h.dropSubscriber(key.(string))
+		}
+		return true
+	})
+}
+
+// HandleEnvelope handles a message from another node.
+func (h *Hub) HandleEnvelope(env *federation.Envelope) {
+	switch env.Type {
+	case federation.TypeDisplays:
+		known := make(map[string]bool, len(env.DisplayIDs))
+		for _, id := range env.DisplayIDs {
+			known[id] = true
+			h.addRemoteDisplay(env.Node, id)
+		}
+		h.remoteDisplays.Range(func(key, value any) bool {
+			if value.(string) == env.Node && !known[key.(string)] && h.remoteDisplays.CompareAndDelete(key, value) {
+				h.handleDisplayDisconnection(key.(string))
+			}
+			return true
+		})
+	case federation.TypeDisplayUp:
+		h.addRemoteDisplay(env.Node, env.Display)
+	case federation.TypeDisplayDown:
+		if h.remoteDisplays.CompareAndDelete(env.Display, env.Node) {
+			h.handleDisplayDisconnection(env.Display)
+		}
+	case federation.TypeSubscribe:
+		h.handleRemoteSubscribe(env.Node, env.Controller, env.Display)
+	case federation.TypeUnsubscribe:
+		if d, ok := h.displayEntities.Load(env.Display); ok {
+			display := d.(*domain.Display)
+			count := display.RemoveSubscriber(env.Controller)
+			h.send(env.Display, "server", "unsubscribed", domain.UnsubscribedPayload{Count: count})
+		}
+		h.forgetRemoteController(env.Controller)
+	case federation.TypeCommand:
+		// Remember where the controller is so that errors and results reach it.
+		h.remoteControllers.Store(env.Controller, env.Node)
+		var payload domain.CommandPayload
+		if err := json.Unmarshal(env.Message, &payload); err != nil || payload.Name == "" {
+			h.sendError(env.Controller, domain.NewError(domain.ErrInvalidCommandFormat, "command payload must be an object with a name"))
+			return
+		}
+		h.dispatchCommand(traceContext(env.Trace), env.Controller, env.Display, env.ID, env.Message, &payload)
+	case federation.TypeDeliver:
+		var msg domain.OutgoingMessage
+		if err := json.Unmarshal(env.Message, &msg); err != nil {
+			slog.Warn("Federation: invalid message", "node", env.Node, "error", err)
+			return
+		}
+		h.deliverBytes(msg.From, msg.Type, env.Targets, env.Message, false)
+	default:
+		slog.Warn("Federation: unknown message type", "node", env.Node, "type", env.Type)
+	}
+}
+
+// addRemoteDisplay records a display registered on another node and subscribes
+// the local controllers that are waiting for it.
+func (h *Hub) addRemoteDisplay(node, displayID string) {
+	if _, local := h.displayEntities.Load(displayID); local {
+		slog.Warn("Federation: display is registered both here and on another node", "client_id", displayID, "client_type", "display", "node", node)
+		return
+	}
+	h.remoteDisplays.Store(displayID, node)
+	h.postDisplayRegistration(context.Background(), displayID)
+}
+
+// handleRemoteSubscribe subscribes a controller on another node to a local display.
+func (h *Hub) handleRemoteSubscribe(node, controllerID, displayID string) {
+	d, ok := h.displayEntities.Load(displayID)
+	if !ok {
+		// The other node is out of date; let it move the controller to waiting.
+		h.federate(node, &federation.Envelope{Type: federation.TypeDisplayDown, Display: displayID})
+		return
+	}
+	display := d.(*domain.Display)
+	h.remoteControllers.Store(controllerID, node)
+
+	display.Mu.Lock()
+	display.Subscribers[controllerID] = true
+	count := len(display.Subscribers)
+	display.Mu.Unlock()
+
+	h.sendRaw(controllerID, displayID, "command_list", display.LastCommandList())
+	if status := display.LastStatus(); status != nil {
+		h.sendRaw(controllerID, displayID, "status", status)
+	}
+	h.send(displayID, "server", "subscribed", domain.SubscribedPayload{Count: count})
+}
+
+// subscribeRemote subscribes a local controller to a display on another node,
+// which answers with the display's command list.
+func (h *Hub) subscribeRemote(node, controllerID, displayID string) {
+	h.federate(node, &federation.Envelope{Type: federation.TypeSubscribe, Controller: controllerID, Display: displayID})
+}
+
+// unsubscribeRemote removes a local controller from a display on another node.
+func (h *Hub) unsubscribeRemote(controllerID, displayID string) {
+	if node, ok := h.remoteDisplayNode(displayID); ok {
+		h.federate(node, &federation.Envelope{Type: federation.TypeUnsubscribe, Controller: controllerID, Display: displayID})
+	}
+}
+
+// dropSubscriber removes a controller that is no longer reachable from every
+// local display.
+func (h *Hub) dropSubscriber(controllerID string) {
+	h.displayEntities.Range(func(key, value any) bool {
+		display := value.(*domain.Display)
+		display.Mu.Lock()
+		_, subscribed := display.Subscribers[controllerID]
+		delete(display.Subscribers, controllerID)
+		count := len(display.Subscribers)
+		display.Mu.Unlock()
+		if subscribed {
+			h.send(display.ID, "server", "unsubscribed", domain.UnsubscribedPayload{Count: count})
+		}
+		return true
+	})
+}
+
+// forgetRemoteController drops the route to a controller on another node once
+// it is no longer subscribed to any local display.
+func (h *Hub) forgetRemoteController(controllerID string) {
+	subscribed := false
+	h.displayEntities.Range(func(key, value any) bool {
+		display := value.(*domain.Display)
+		display.Mu.Lock()
+		subscribed = display.Subscribers[controllerID]
+		display.Mu.Unlock()
+		return !subscribed
+	})
+	if !subscribed {
+		h.remoteControllers.Delete(controllerID)
+	}
+}
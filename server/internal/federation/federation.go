@@ -0,0 +1,61 @@
+// Package federation lets several relay servers share one display namespace by
+// exchanging registrations and routed messages through a Broker.
+package federation
+
+import "encoding/json"
+
+// Envelope types exchanged between nodes.
+const (
+	// TypeDisplays carries the full list of displays registered on the sending node.
+	TypeDisplays = "displays"
+	// TypeDisplayUp announces that Display was registered on the sending node.
+	TypeDisplayUp = "display_up"
+	// TypeDisplayDown announces that Display was removed from the sending node.
+	TypeDisplayDown = "display_down"
+	// TypeSubscribe subscribes Controller to Display, which lives on the receiving node.
+	TypeSubscribe = "subscribe"
+	// TypeUnsubscribe removes Controller from the subscribers of Display.
+	TypeUnsubscribe = "unsubscribe"
+	// TypeCommand forwards a command from Controller to Display.
+	TypeCommand = "command"
+	// TypeDeliver asks the receiving node to deliver Message to its local Targets.
+	TypeDeliver = "deliver"
+)
+
+// Envelope is a message exchanged between nodes.
+type Envelope struct {
+	Type       string            `json:"type"`
+	Node       string            `json:"node,omitempty"` // Sending node, filled in by the broker
+	DisplayIDs []string          `json:"display_ids,omitempty"`
+	Display    string            `json:"display,omitempty"`
+	Controller string            `json:"controller,omitempty"`
+	ID         string            `json:"id,omitempty"` // Command correlation ID chosen by the controller
+	Targets    []string          `json:"targets,omitempty"`
+	Message    json.RawMessage   `json:"message,omitempty"`
+	Trace      map[string]string `json:"trace,omitempty"` // Trace context of a forwarded command
+}
+
+// Handler receives envelopes and link events from a Broker.
+type Handler interface {
+	// HandleEnvelope is called for every envelope received from another node.
+	HandleEnvelope(env *Envelope)
+	// PeerUp is called when a node becomes reachable.
+	PeerUp(node string)
+	// PeerDown is called when a node is no longer reachable. Everything learned
+	// from it should be forgotten.
+	PeerDown(node string)
+}
+
+// Broker exchanges envelopes between relay nodes.
+type Broker interface {
+	// NodeID returns the ID of the local node.
+	NodeID() string
+	// Start connects to the other nodes and reports to handler.
+	Start(handler Handler)
+	// Send sends env to a single node.
+	Send(node string, env *Envelope)
+	// Broadcast sends env to every reachable node.
+	Broadcast(env *Envelope)
+	// Close disconnects from all nodes.
+	Close() error
+}
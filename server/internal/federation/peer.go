@@ -0,0 +1,271 @@
+package federation
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// NodeHeader carries the node ID during the link handshake.
+	NodeHeader = "X-Controly-Node"
+
+	linkWriteWait  = 10 * time.Second
+	linkPongWait   = 60 * time.Second
+	linkPingPeriod = (linkPongWait * 9) / 10
+	linkRetryDelay = 2 * time.Second
+	linkBufferSize = 1024
+)
+
+// PeerBroker is a Broker that links nodes directly over WebSocket. Every node
+// dials each of its peers and sends over these outbound links, while it
+// receives over the links its peers dialled in. Each node must therefore list
+// every other node as a peer.
+type PeerBroker struct {
+	nodeID string
+	peers  []string // WebSocket URLs of the peers' federation endpoints
+	secret string
+
+	handler  Handler
+	upgrader websocket.Upgrader
+	dialer   *websocket.Dialer
+
+	mu    sync.Mutex
+	links map[string]*peerLink // Outbound links by node ID
+	done  chan struct{}
+}
+
+type peerLink struct {
+	node string
+	conn *websocket.Conn
+	send chan []byte
+}
+
+// NewPeerBroker creates a PeerBroker for the local node. Links are
+// authenticated with the shared secret, if set.
+func NewPeerBroker(nodeID string, peers []string, secret string) *PeerBroker {
+	return &PeerBroker{
+		nodeID: nodeID,
+		peers:  peers,
+		secret: secret,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  4096,
+			WriteBufferSize: 4096,
+		},
+		dialer: websocket.DefaultDialer,
+		links:  make(map[string]*peerLink),
+		done:   make(chan struct{}),
+	}
+}
+
+// UseTLS sets the TLS configuration links to wss:// peers are dialled with,
+// e.g. to verify peers against a private CA or to present a client
+// certificate to peers that require one.
+func (b *PeerBroker) UseTLS(config *tls.Config) {
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = config
+	b.dialer = &dialer
+}
+
+func (b *PeerBroker) NodeID() string {
+	return b.nodeID
+}
+
+func (b *PeerBroker) Start(handler Handler) {
+	b.handler = handler
+	for _, peer := range b.peers {
+		go b.maintainLink(peer)
+	}
+}
+
+func (b *PeerBroker) Send(node string, env *Envelope) {
+	b.mu.Lock()
+	link := b.links[node]
+	b.mu.Unlock()
+	if link == nil {
+		slog.Warn("Federation: no link to node, message dropped", "node", node, "type", env.Type)
+		return
+	}
+	b.sendOn(link, env)
+}
+
+func (b *PeerBroker) Broadcast(env *Envelope) {
+	b.mu.Lock()
+	links := make([]*peerLink, 0, len(b.links))
+	for _, link := range b.links {
+		links = append(links, link)
+	}
+	b.mu.Unlock()
+	for _, link := range links {
+		b.sendOn(link, env)
+	}
+}
+
+func (b *PeerBroker) sendOn(link *peerLink, env *Envelope) {
+	env.Node = b.nodeID
+	data, err := json.Marshal(env)
+	if err != nil {
+		slog.Error("Federation: error marshalling message", "type", env.Type, "error", err)
+		return
+	}
+	select {
+	case link.send <- data:
+	default:
+		slog.Warn("Federation: send channel full, message dropped", "node", link.node, "type", env.Type)
+	}
+}
+
+func (b *PeerBroker) Close() error {
+	close(b.done)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, link := range b.links {
+		link.conn.Close()
+	}
+	return nil
+}
+
+// maintainLink keeps an outbound link to a peer open, redialling when it drops.
+func (b *PeerBroker) maintainLink(url string) {
+	header := http.Header{}
+	header.Set(NodeHeader, b.nodeID)
+	if b.secret != "" {
+		header.Set("Authorization", "Bearer "+b.secret)
+	}
+
+	for {
+		conn, resp, err := b.dialer.Dial(url, header)
+		if err == nil {
+			node := resp.Header.Get(NodeHeader)
+			if node == "" || node == b.nodeID {
+				slog.Warn("Federation: peer did not send a valid node ID", "peer", url)
+				conn.Close()
+			} else {
+				b.runLink(&peerLink{node: node, conn: conn, send: make(chan []byte, linkBufferSize)})
+			}
+		} else {
+			slog.Warn("Federation: could not connect to peer", "peer", url, "error", err)
+		}
+
+		select {
+		case <-b.done:
+			return
+		case <-time.After(linkRetryDelay):
+		}
+	}
+}
+
+// runLink registers an outbound link and pumps messages to it until it closes.
+func (b *PeerBroker) runLink(link *peerLink) {
+	b.mu.Lock()
+	if old := b.links[link.node]; old != nil {
+		old.conn.Close()
+	}
+	b.links[link.node] = link
+	b.mu.Unlock()
+	slog.Info("Federation: linked to node", "node", link.node)
+	b.handler.PeerUp(link.node)
+
+	// Nothing is read from outbound links; the reader only handles pongs and
+	// notices when the connection is gone.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		link.conn.SetReadDeadline(time.Now().Add(linkPongWait))
+		link.conn.SetPongHandler(func(string) error {
+			link.conn.SetReadDeadline(time.Now().Add(linkPongWait))
+			return nil
+		})
+		for {
+			if _, _, err := link.conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(linkPingPeriod)
+	defer ticker.Stop()
+loop:
+	for {
+		select {
+		case data := <-link.send:
+			link.conn.SetWriteDeadline(time.Now().Add(linkWriteWait))
+			if err := link.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				break loop
+			}
+		case <-ticker.C:
+			link.conn.SetWriteDeadline(time.Now().Add(linkWriteWait))
+			if err := link.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				break loop
+			}
+		case <-closed:
+			break loop
+		}
+	}
+	link.conn.Close()
+
+	b.mu.Lock()
+	current := b.links[link.node] == link
+	if current {
+		delete(b.links, link.node)
+	}
+	b.mu.Unlock()
+	if current {
+		slog.Warn("Federation: link to node lost", "node", link.node)
+		b.handler.PeerDown(link.node)
+	}
+}
+
+// ServeHTTP accepts inbound links from peers and hands their envelopes to the handler.
+func (b *PeerBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if b.secret != "" {
+		auth := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(auth, []byte("Bearer "+b.secret)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	node := r.Header.Get(NodeHeader)
+	if node == "" || node == b.nodeID {
+		http.Error(w, "missing or invalid "+NodeHeader+" header", http.StatusBadRequest)
+		return
+	}
+	if b.handler == nil {
+		http.Error(w, "federation not started", http.StatusServiceUnavailable)
+		return
+	}
+
+	header := http.Header{}
+	header.Set(NodeHeader, b.nodeID)
+	conn, err := b.upgrader.Upgrade(w, r, header)
+	if err != nil {
+		slog.Warn("Federation: failed to upgrade link", "node", node, "remote_addr", r.RemoteAddr, "error", err)
+		return
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(linkPongWait))
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(linkPongWait))
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(linkWriteWait))
+	})
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var env Envelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			slog.Warn("Federation: invalid message", "node", node, "error", err)
+			continue
+		}
+		env.Node = node
+		b.handler.HandleEnvelope(&env)
+	}
+}
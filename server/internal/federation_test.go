@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/simbafs/controly/server/internal/config"
+	"github.com/simbafs/controly/server/internal/federation"
+)
+
+// startNode runs a federated hub on srv that links to the node at peerURL.
+func startNode(t *testing.T, srv *httptest.Server, nodeID, peerURL string) {
+	t.Helper()
+	cfg := config.Default()
+	cfg.Federation = config.FederationConfig{NodeID: nodeID, Peers: []string{peerURL}, Secret: "secret"}
+	hub := NewHub(cfg)
+	broker := federation.NewPeerBroker(nodeID, cfg.Federation.Peers, cfg.Federation.Secret)
+	hub.UseBroker(broker)
+	go hub.Run()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", hub.ServeWs)
+	mux.Handle("/federation", broker)
+	srv.Config.Handler = mux
+	srv.Start()
+	broker.Start(hub)
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		hub.Shutdown(ctx)
+		broker.Close()
+		srv.Close()
+	})
+}
+
+func TestFederationRoutesBetweenNodes(t *testing.T) {
+	commands := commandServer(t)
+
+	srvA := httptest.NewUnstartedServer(nil)
+	srvB := httptest.NewUnstartedServer(nil)
+	startNode(t, srvA, "a", wsURL(srvB, "/federation"))
+	startNode(t, srvB, "b", wsURL(srvA, "/federation"))
+
+	display := dialClient(t, wsURL(srvA, "/ws?type=display&id=d1&command_url="+commands.URL), nil)
+	display.expect("set_id")
+
+	// The controller waits for the display if node b has not heard of it yet.
+	controller := dialClient(t, wsURL(srvB, "/ws?type=controller&id=c1"), nil)
+	controller.expect("set_id")
+	controller.send(`{"type":"subscribe","payload":{"display_ids":["d1"]}}`)
+	list := controller.expect("command_list")
+	if from := string(list["from"]); from != `"d1"` {
+		t.Errorf("command_list from %s, want \"d1\"", from)
+	}
+	display.expect("subscribed")
+
+	controller.send(`{"type":"command","to":"d1","payload":{"name":"set_time","args":{"value":60}}}`)
+	cmd := display.expect("command")
+	if from := string(cmd["from"]); from != `"c1"` {
+		t.Errorf("command from %s, want \"c1\"", from)
+	}
+	var payload struct {
+		Name string                     `json:"name"`
+		Args map[string]json.RawMessage `json:"args"`
+	}
+	if err := json.Unmarshal(cmd["payload"], &payload); err != nil || payload.Name != "set_time" || string(payload.Args["value"]) != "60" {
+		t.Errorf("command payload = %s", cmd["payload"])
+	}
+
+	display.send(`{"type":"status","payload":{"remaining":60}}`)
+	status := controller.expect("status")
+	if got := string(status["payload"]); got != `{"remaining":60}` {
+		t.Errorf("status payload = %s", got)
+	}
+}
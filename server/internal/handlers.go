@@ -1,18 +1,30 @@
 package internal
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/fs"
-	"log"
+	"log/slog"
 	"math/big"
 	"net/http"
+	"slices"
 	"sort"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/simbafs/controly/server/internal/codec"
 	"github.com/simbafs/controly/server/internal/domain"
+	"github.com/simbafs/controly/server/internal/federation"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // --- HTTP Handlers ---
@@ -28,7 +40,11 @@ func (h *Hub) ConnectionsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		display.Mu.Unlock()
 		sort.Strings(subscribers)
-		displays = append(displays, map[string]any{"id": display.ID, "subscribers": subscribers})
+		displays = append(displays, map[string]any{
+			"id":           display.ID,
+			"subscribers":  subscribers,
+			"reconnecting": contains(&h.detachedDisplays, display.ID),
+		})
 		return true
 	})
 
@@ -42,7 +58,11 @@ func (h *Hub) ConnectionsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		controller.Mu.Unlock()
 		sort.Strings(subscriptions)
-		controllers = append(controllers, map[string]any{"id": controller.ID, "subscriptions": subscriptions})
+		controllers = append(controllers, map[string]any{
+			"id":            controller.ID,
+			"subscriptions": subscriptions,
+			"reconnecting":  contains(&h.detachedControllers, controller.ID),
+		})
 		return true
 	})
 
@@ -50,25 +70,107 @@ func (h *Hub) ConnectionsHandler(w http.ResponseWriter, r *http.Request) {
 		"displays":    displays,
 		"controllers": controllers,
 	}
+	if h.broker != nil {
+		remoteDisplays := []map[string]any{}
+		h.remoteDisplays.Range(func(key, value any) bool {
+			remoteDisplays = append(remoteDisplays, map[string]any{
+				"id":   key.(string),
+				"node": value.(string),
+			})
+			return true
+		})
+		response["node"] = h.broker.NodeID()
+		response["remote_displays"] = remoteDisplays
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// StatsHandler returns the traffic and compression stats of every connection.
+func (h *Hub) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := []ConnStatsSnapshot{}
+	collect := func(key, value any) bool {
+		client := value.(*Client)
+		stats = append(stats, client.stats.snapshot(client))
+		return true
+	}
+	h.displays.Range(collect)
+	h.controllers.Range(collect)
+	h.inspectors.Range(collect)
+	sort.Slice(stats, func(i, j int) bool { return stats[i].ID < stats[j].ID })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// DisplayStatusHandler returns the last status a display has sent, or null if
+// it has not sent one yet.
+func (h *Hub) DisplayStatusHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	d, ok := h.displayEntities.Load(id)
+	if !ok {
+		http.Error(w, "display not found", http.StatusNotFound)
+		return
+	}
+	status := d.(*domain.Display).LastStatus()
+	if status == nil {
+		status = json.RawMessage("null")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(status)
+}
+
 // --- WebSocket Message Handlers ---
 
 func (h *Hub) handleDisplayMessage(client *Client, msg *domain.IncomingMessage) {
-	if msg.Type == "status" {
+	switch msg.Type {
+	case "command_result":
+		h.handleCommandResult(client.id, msg)
+	case "status":
 		if d, ok := h.displayEntities.Load(client.id); ok {
-			display := d.(*domain.Display)
-			display.Mu.Lock()
-			subscribers := make([]string, 0, len(display.Subscribers))
-			for id := range display.Subscribers {
-				subscribers = append(subscribers, id)
+			ctx, span := tracer.Start(traceContext(msg.Trace), "status", trace.WithAttributes(attribute.String("controly.display_id", client.id)))
+			subscribers := d.(*domain.Display).SetStatus(msg.Payload)
+			span.SetAttributes(attribute.Int("controly.subscribers", len(subscribers)))
+			if len(subscribers) > 0 {
+				h.deliver(subscribers, domain.OutgoingMessage{Type: "status", From: client.id, Payload: msg.Payload, Trace: traceFields(ctx)})
+			}
+			h.touchDisplay(client.id)
+			span.End()
+		}
+	case "status_patch":
+		d, ok := h.displayEntities.Load(client.id)
+		if !ok {
+			return
+		}
+		ctx, span := tracer.Start(traceContext(msg.Trace), "status_patch", trace.WithAttributes(attribute.String("controly.display_id", client.id)))
+		defer span.End()
+		status, subscribers, err := d.(*domain.Display).ApplyStatusPatch(msg.Payload)
+		if err != nil {
+			err = domain.NewError(domain.ErrInvalidMessageFormat, "invalid status_patch payload: %v", err)
+			recordError(span, err)
+			h.sendError(client.id, err)
+			return
+		}
+		span.SetAttributes(attribute.Int("controly.subscribers", len(subscribers)))
+		var patchTargets, fullTargets []string
+		for _, id := range subscribers {
+			if c, ok := h.controllerEntities.Load(id); ok && c.(*domain.Controller).WantsStatusPatches() {
+				patchTargets = append(patchTargets, id)
+			} else {
+				fullTargets = append(fullTargets, id)
 			}
-			display.Mu.Unlock()
-			h.broadcast(subscribers, client.id, "status", msg.Payload)
 		}
+		tc := traceFields(ctx)
+		if len(patchTargets) > 0 {
+			h.deliver(patchTargets, domain.OutgoingMessage{Type: "status_patch", From: client.id, Payload: msg.Payload, Trace: tc})
+		}
+		if len(fullTargets) > 0 {
+			h.deliver(fullTargets, domain.OutgoingMessage{Type: "status", From: client.id, Payload: status, Trace: tc})
+		}
+		h.touchDisplay(client.id)
+	default:
+		h.sendError(client.id, domain.NewError(domain.ErrInvalidMessageFormat, "unknown message type: %s", msg.Type))
 	}
 }
 
@@ -78,73 +180,217 @@ func (h *Hub) handleControllerMessage(client *Client, msg *domain.IncomingMessag
 		var payload struct {
 			DisplayIDs []string `json:"display_ids"`
 		}
-		json.Unmarshal(msg.Payload, &payload)
-		h.handleSubscribe(client.id, payload.DisplayIDs)
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			h.sendError(client.id, domain.NewError(domain.ErrInvalidMessageFormat, "invalid subscribe payload: %v", err))
+			return
+		}
+		h.handleSubscribe(traceContext(msg.Trace), client.id, payload.DisplayIDs)
 	case "unsubscribe":
 		var payload struct {
 			DisplayIDs []string `json:"display_ids"`
 		}
-		json.Unmarshal(msg.Payload, &payload)
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			h.sendError(client.id, domain.NewError(domain.ErrInvalidMessageFormat, "invalid unsubscribe payload: %v", err))
+			return
+		}
 		h.handleUnsubscribe(client.id, payload.DisplayIDs)
 	case "command":
-		h.sendRaw(msg.To, client.id, "command", msg.Payload)
+		h.handleCommand(client.id, msg)
 	case "waiting":
 		var displayIDs []string
-		json.Unmarshal(msg.Payload, &displayIDs)
+		if err := json.Unmarshal(msg.Payload, &displayIDs); err != nil {
+			h.sendError(client.id, domain.NewError(domain.ErrInvalidMessageFormat, "invalid waiting payload: %v", err))
+			return
+		}
 		h.handleWaitingList(client.id, displayIDs)
+	default:
+		h.sendError(client.id, domain.NewError(domain.ErrInvalidMessageFormat, "unknown message type: %s", msg.Type))
 	}
 }
 
 // --- Business Logic (previously use cases) ---
 
-func (h *Hub) handleNewDisplay(displayID, commandURL, token string) (string, error) {
-	if h.serverToken != "" && h.serverToken != token {
-		return "", fmt.Errorf("invalid token")
+// handleNewDisplay registers a display, or reattaches a reconnecting one. As
+// with controllers, a detached display is reattached by any connection with
+// its ID, but a display that is still connected only by one that presents its
+// resume token. It reports whether an existing display was reattached.
+func (h *Hub) handleNewDisplay(ctx context.Context, displayID, commandURL, resumeToken string) (string, bool, error) {
+	newToken, err := generateRandomString(32, "")
+	if err != nil {
+		return "", false, err
 	}
 
 	if displayID == "" {
-		var err error
 		displayID, err = h.generateUniqueDisplayID()
 		if err != nil {
-			return "", err
+			return "", false, err
 		}
+	} else if _, exists := h.controllerEntities.Load(displayID); exists {
+		return "", false, domain.NewError(domain.ErrDisplayIDConflict, "display ID conflict: %s", displayID)
+	} else if _, exists := h.remoteDisplays.Load(displayID); exists {
+		return "", false, domain.NewError(domain.ErrDisplayIDConflict, "display ID conflict: %s is registered on another node", displayID)
 	}
 
-	if _, exists := h.displayEntities.Load(displayID); exists {
-		return "", fmt.Errorf("display ID conflict: %s", displayID)
+	existing, exists := h.displayEntities.Load(displayID)
+	tokenValid := false
+	if exists {
+		display := existing.(*domain.Display)
+		display.Mu.Lock()
+		tokenValid = resumeToken != "" && subtle.ConstantTimeCompare([]byte(resumeToken), []byte(display.ResumeToken)) == 1
+		display.Mu.Unlock()
+	}
+	if exists && !tokenValid && !contains(&h.detachedDisplays, displayID) {
+		return "", false, domain.NewError(domain.ErrDisplayIDConflict, "display ID conflict: %s", displayID)
 	}
 
-	commandData, err := fetchCommands(commandURL)
+	commandData, err := fetchCommands(ctx, commandURL)
 	if err != nil {
-		return "", err
+		return "", false, err
+	}
+	commands, err := domain.ParseCommandList(commandData)
+	if err != nil {
+		return "", false, err
+	}
+
+	// The display is either reconnecting, or its old connection has not timed
+	// out yet and is taken over in registerClient. If neither holds, the grace
+	// period ran out in the meantime and the display registers afresh.
+	if exists && (claimSession(&h.detachedDisplays, displayID) || tokenValid && contains(&h.displays, displayID)) {
+		display := existing.(*domain.Display)
+		display.Mu.Lock()
+		display.ResumeToken = newToken
+		display.Mu.Unlock()
+		h.updateCommandList(display, commandData, commands)
+		return displayID, true, nil
 	}
 
-	display := domain.NewDisplay(displayID, commandData)
-	h.displayEntities.Store(displayID, display)
-	return displayID, nil
+	display := domain.NewDisplay(displayID, commandData, commands, newToken)
+	if _, loaded := h.displayEntities.LoadOrStore(displayID, display); loaded {
+		return "", false, domain.NewError(domain.ErrDisplayIDConflict, "display ID conflict: %s", displayID)
+	}
+	return displayID, false, nil
 }
 
-func (h *Hub) handleNewController() (string, error) {
-	// Simple incremental ID for controllers
-	var controllerID string
-	var err error
-	for {
-		controllerID, err = generateRandomString(8, "controller-")
-		if err != nil {
-			return "", err
+// updateCommandList replaces the command list of a reattached display and
+// sends it to the subscribers if it has changed.
+func (h *Hub) updateCommandList(display *domain.Display, commandData json.RawMessage, commands map[string]*domain.CommandDefinition) {
+	display.Mu.Lock()
+	if bytes.Equal(display.CommandList, commandData) {
+		display.Mu.Unlock()
+		return
+	}
+	display.CommandList = commandData
+	display.Commands = commands
+	subscribers := make([]string, 0, len(display.Subscribers))
+	for id := range display.Subscribers {
+		subscribers = append(subscribers, id)
+	}
+	display.Mu.Unlock()
+	h.broadcast(subscribers, display.ID, "command_list", commandData)
+}
+
+// restoreDisplaySession tells a reattached display how many controllers are
+// still subscribed to it.
+func (h *Hub) restoreDisplaySession(displayID string) {
+	d, ok := h.displayEntities.Load(displayID)
+	if !ok {
+		return
+	}
+	display := d.(*domain.Display)
+	display.Mu.Lock()
+	count := len(display.Subscribers)
+	display.Mu.Unlock()
+	h.send(displayID, "server", "subscribed", domain.SubscribedPayload{Count: count})
+}
+
+// handleNewController creates a controller session, or resumes an existing one.
+// A detached session is resumed by any connection with its ID, such as a page
+// reload that lost the resume token, but a session that is still connected
+// only by one that presents its resume token. It reports whether an existing
+// session was resumed.
+func (h *Hub) handleNewController(controllerID, resumeToken string) (string, bool, error) {
+	token, err := generateRandomString(32, "")
+	if err != nil {
+		return "", false, err
+	}
+
+	if controllerID == "" {
+		for {
+			controllerID, err = generateRandomString(idLength, "controller-")
+			if err != nil {
+				return "", false, err
+			}
+			if _, exists := h.controllerEntities.Load(controllerID); !exists {
+				break
+			}
+		}
+	} else if _, exists := h.displayEntities.Load(controllerID); exists {
+		return "", false, domain.NewError(domain.ErrControllerIDConflict, "controller ID conflict: %s", controllerID)
+	}
+
+	if c, exists := h.controllerEntities.Load(controllerID); exists {
+		controller := c.(*domain.Controller)
+		controller.Mu.Lock()
+		defer controller.Mu.Unlock()
+		tokenValid := resumeToken != "" && subtle.ConstantTimeCompare([]byte(resumeToken), []byte(controller.ResumeToken)) == 1
+		if !tokenValid && !contains(&h.detachedControllers, controllerID) {
+			return "", false, domain.NewError(domain.ErrControllerIDConflict, "controller ID conflict: %s", controllerID)
 		}
-		if _, exists := h.controllerEntities.Load(controllerID); !exists {
-			break
+		// As with displays, the session is either detached or its old
+		// connection is taken over in registerClient.
+		if claimSession(&h.detachedControllers, controllerID) || tokenValid && contains(&h.controllers, controllerID) {
+			controller.ResumeToken = token
+			return controllerID, true, nil
+		}
+	}
+
+	controller := domain.NewController(controllerID, token)
+	if _, loaded := h.controllerEntities.LoadOrStore(controllerID, controller); loaded {
+		return "", false, domain.NewError(domain.ErrControllerIDConflict, "controller ID conflict: %s", controllerID)
+	}
+	return controllerID, false, nil
+}
+
+// restoreControllerSession sends a resumed controller the state of its session:
+// the command list of every display it is subscribed to and its waiting list.
+func (h *Hub) restoreControllerSession(controllerID string) {
+	c, ok := h.controllerEntities.Load(controllerID)
+	if !ok {
+		return
+	}
+	controller := c.(*domain.Controller)
+	if claims := h.controllerClaims(controllerID); claims != nil {
+		h.restrictSession(controller, claims)
+	}
+	controller.Mu.Lock()
+	subscriptions := make([]string, 0, len(controller.Subscriptions))
+	for id := range controller.Subscriptions {
+		subscriptions = append(subscriptions, id)
+	}
+	waitingList := make([]string, 0, len(controller.WaitingFor))
+	for id := range controller.WaitingFor {
+		waitingList = append(waitingList, id)
+	}
+	controller.Mu.Unlock()
+
+	for _, displayID := range subscriptions {
+		if d, ok := h.displayEntities.Load(displayID); ok {
+			display := d.(*domain.Display)
+			h.sendRaw(controllerID, displayID, "command_list", display.LastCommandList())
+			if status := display.LastStatus(); status != nil {
+				h.sendRaw(controllerID, displayID, "status", status)
+			}
+		} else if node, ok := h.remoteDisplayNode(displayID); ok {
+			h.subscribeRemote(node, controllerID, displayID)
 		}
 	}
-	controller := domain.NewController(controllerID)
-	h.controllerEntities.Store(controllerID, controller)
-	return controllerID, nil
+	h.send(controllerID, "server", "waiting", waitingList)
 }
 
-func (h *Hub) postDisplayRegistration(displayID string) {
-	display, _ := h.displayEntities.Load(displayID)
-	if display == nil {
+func (h *Hub) postDisplayRegistration(ctx context.Context, displayID string) {
+	if _, ok := h.displayEntities.Load(displayID); ok {
+		h.announce(&federation.Envelope{Type: federation.TypeDisplayUp, Display: displayID})
+	} else if !h.isDisplayOnline(displayID) {
 		return
 	}
 
@@ -155,13 +401,15 @@ func (h *Hub) postDisplayRegistration(displayID string) {
 		controller.Mu.Unlock()
 
 		if isWaiting {
-			h.handleSubscribe(controller.ID, []string{displayID})
+			h.handleSubscribe(ctx, controller.ID, []string{displayID})
 		}
 		return true
 	})
 }
 
 func (h *Hub) handleDisplayDisconnection(displayID string) {
+	h.failPendingCommands(displayID, "display disconnected")
+
 	h.controllerEntities.Range(func(key, value any) bool {
 		controller := value.(*domain.Controller)
 		controller.Mu.Lock()
@@ -176,6 +424,7 @@ func (h *Hub) handleDisplayDisconnection(displayID string) {
 
 			h.send(controller.ID, "server", "display_disconnected", domain.DisplayDisconnectedPayload{DisplayID: displayID})
 			h.send(controller.ID, "server", "waiting", waitingList)
+			h.touchController(controller.ID)
 		}
 		controller.Mu.Unlock()
 		return true
@@ -195,26 +444,49 @@ func (h *Hub) handleControllerDisconnection(controllerID string) {
 		for _, displayID := range subscriptions {
 			if d, ok := h.displayEntities.Load(displayID); ok {
 				display := d.(*domain.Display)
-				display.RemoveSubscriber(controllerID)
-				h.send(displayID, "server", "unsubscribed", domain.UnsubscribedPayload{Count: len(display.Subscribers)})
+				count := display.RemoveSubscriber(controllerID)
+				h.send(displayID, "server", "unsubscribed", domain.UnsubscribedPayload{Count: count})
+				h.touchDisplay(displayID)
+			} else {
+				h.unsubscribeRemote(controllerID, displayID)
 			}
 		}
 	}
 }
 
-func (h *Hub) handleSubscribe(controllerID string, displayIDs []string) {
+func (h *Hub) handleSubscribe(ctx context.Context, controllerID string, displayIDs []string) {
+	_, span := tracer.Start(ctx, "subscribe", trace.WithAttributes(
+		attribute.String("controly.controller_id", controllerID),
+		attribute.StringSlice("controly.display_ids", displayIDs),
+	))
+	defer span.End()
+
 	c, _ := h.controllerEntities.Load(controllerID)
 	if c == nil {
 		return
 	}
 	controller := c.(*domain.Controller)
+	claims := h.controllerClaims(controllerID)
 
 	for _, displayID := range displayIDs {
+		if claims != nil && !claims.AllowsDisplay(displayID) {
+			h.sendError(controllerID, domain.NewError(domain.ErrPermissionDenied, "not allowed to subscribe to display: %s", displayID))
+			continue
+		}
 		d, ok := h.displayEntities.Load(displayID)
 		if !ok {
+			node, remote := h.remoteDisplayNode(displayID)
 			controller.Mu.Lock()
-			controller.WaitingFor[displayID] = true
+			if remote {
+				delete(controller.WaitingFor, displayID)
+				controller.Subscriptions[displayID] = true
+			} else {
+				controller.WaitingFor[displayID] = true
+			}
 			controller.Mu.Unlock()
+			if remote {
+				h.subscribeRemote(node, controllerID, displayID)
+			}
 			continue
 		}
 		display := d.(*domain.Display)
@@ -226,11 +498,17 @@ func (h *Hub) handleSubscribe(controllerID string, displayIDs []string) {
 
 		display.Mu.Lock()
 		display.Subscribers[controllerID] = true
+		count := len(display.Subscribers)
 		display.Mu.Unlock()
 
-		h.sendRaw(controllerID, displayID, "command_list", display.CommandList)
-		h.send(displayID, "server", "subscribed", domain.SubscribedPayload{Count: len(display.Subscribers)})
+		h.sendRaw(controllerID, displayID, "command_list", display.LastCommandList())
+		if status := display.LastStatus(); status != nil {
+			h.sendRaw(controllerID, displayID, "status", status)
+		}
+		h.send(displayID, "server", "subscribed", domain.SubscribedPayload{Count: count})
+		h.touchDisplay(displayID)
 	}
+	h.touchController(controllerID)
 
 	controller.Mu.Lock()
 	waitingList := make([]string, 0, len(controller.WaitingFor))
@@ -253,11 +531,15 @@ func (h *Hub) handleUnsubscribe(controllerID string, displayIDs []string) {
 		delete(controller.Subscriptions, displayID)
 		if d, ok := h.displayEntities.Load(displayID); ok {
 			display := d.(*domain.Display)
-			display.RemoveSubscriber(controllerID)
-			h.send(displayID, "server", "unsubscribed", domain.UnsubscribedPayload{Count: len(display.Subscribers)})
+			count := display.RemoveSubscriber(controllerID)
+			h.send(displayID, "server", "unsubscribed", domain.UnsubscribedPayload{Count: count})
+			h.touchDisplay(displayID)
+		} else {
+			h.unsubscribeRemote(controllerID, displayID)
 		}
 	}
 	controller.Mu.Unlock()
+	h.touchController(controllerID)
 }
 
 func (h *Hub) handleWaitingList(controllerID string, displayIDs []string) {
@@ -266,13 +548,18 @@ func (h *Hub) handleWaitingList(controllerID string, displayIDs []string) {
 		return
 	}
 	controller := c.(*domain.Controller)
-
-	isDisplayOnline := func(id string) bool {
-		_, ok := h.displayEntities.Load(id)
-		return ok
+	if claims := h.controllerClaims(controllerID); claims != nil {
+		displayIDs = slices.DeleteFunc(displayIDs, func(id string) bool {
+			if claims.AllowsDisplay(id) {
+				return false
+			}
+			h.sendError(controllerID, domain.NewError(domain.ErrPermissionDenied, "not allowed to subscribe to display: %s", id))
+			return true
+		})
 	}
 
-	finalList := controller.SetWaitingList(displayIDs, isDisplayOnline)
+	finalList := controller.SetWaitingList(displayIDs, h.isDisplayOnline)
+	h.touchController(controllerID)
 	h.send(controllerID, "server", "waiting", finalList)
 }
 
@@ -295,66 +582,104 @@ func generateRandomString(length int, prefix string) (string, error) {
 	return prefix + string(bytes), nil
 }
 
+// contains reports whether m holds a client or session with the given ID.
+func contains(m *sync.Map, id string) bool {
+	_, ok := m.Load(id)
+	return ok
+}
+
 func (h *Hub) generateUniqueDisplayID() (string, error) {
 	for {
 		id, err := generateRandomString(idLength, "")
 		if err != nil {
 			return "", err
 		}
-		if _, exists := h.displayEntities.Load(id); !exists {
+		if !h.isDisplayOnline(id) {
 			return id, nil
 		}
 	}
 }
 
-func fetchCommands(url string) ([]byte, error) {
+func fetchCommands(ctx context.Context, url string) ([]byte, error) {
 	if url == "" {
-		return nil, fmt.Errorf("command_url is required")
+		return nil, domain.NewError(domain.ErrInvalidQueryParams, "request is missing required query parameter: command_url")
 	}
-	resp, err := http.Get(url)
+	ctx, span := tracer.Start(ctx, "fetch_commands", trace.WithAttributes(attribute.String("url.full", url)))
+	defer span.End()
+	start := time.Now()
+	data, err := fetchCommandURL(ctx, url)
+	result := "success"
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch command URL: %w", err)
+		result = "error"
+		recordError(span, err)
+	}
+	commandFetchDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	return data, err
+}
+
+func fetchCommandURL(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, domain.NewError(domain.ErrCommandURLUnreachable, "invalid command URL: %v", err)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, domain.NewError(domain.ErrCommandURLUnreachable, "failed to fetch command URL: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("command URL returned status code: %d", resp.StatusCode)
+		return nil, domain.NewError(domain.ErrCommandURLUnreachable, "command URL returned status code: %d", resp.StatusCode)
 	}
 
 	commandData, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read command JSON: %w", err)
+		return nil, domain.NewError(domain.ErrCommandURLUnreachable, "failed to read command JSON: %v", err)
+	}
+	// Compacted so that the list compares equal to the copy in the store.
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, commandData); err != nil {
+		return nil, domain.NewError(domain.ErrInvalidCommandJSON, "command URL did not return valid JSON")
 	}
-	return commandData, nil
+	return compact.Bytes(), nil
 }
 
 // Inspector Handler
 func (h *Hub) InspectorWsHandler(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	logger := slog.With("client_type", domain.ClientTypeInspector.String(), "remote_addr", r.RemoteAddr)
+	conn, stats, err := h.upgrade(w, r, domain.ClientTypeInspector.String())
 	if err != nil {
-		log.Printf("Failed to upgrade inspector connection: %v", err)
+		logger.Warn("Failed to upgrade inspector connection", "error", err)
+		return
+	}
+	claims, err := h.authorizeInspector(r, conn)
+	if err != nil {
+		logger.Info("Inspector authentication failed", "error", err)
+		h.rejectConn(conn, err)
 		return
 	}
 
 	// Generate a unique ID for the inspector client
 	inspectorID, err := generateRandomString(8, "inspector-")
 	if err != nil {
-		log.Printf("Failed to generate inspector ID: %v", err)
-		conn.Close()
+		logger.Error("Failed to generate inspector ID", "error", err)
+		h.rejectConn(conn, err)
 		return
 	}
 
 	client := &Client{
 		hub:        h,
 		conn:       conn,
-		send:       make(chan []byte, 256),
+		send:       make(chan []byte, h.sendBufferSize),
 		id:         inspectorID,
 		clientType: domain.ClientTypeInspector,
+		codec:      codec.Lookup(conn.Subprotocol()),
+		stats:      stats,
+		log:        logger.With("client_id", inspectorID),
+		claims:     claims,
 	}
-	h.register <- client
-
-	go client.writePump()
-	go client.readPump()
+	h.startClient(client)
 }
 
 func (h *Hub) FrontendHandler(contentFs fs.FS) http.Handler {
@@ -366,7 +691,13 @@ func (h *Hub) DeleteDisplayHandler(w http.ResponseWriter, r *http.Request) {
 	id := vars["id"]
 	if c, ok := h.displays.Load(id); ok {
 		client := c.(*Client)
-		h.unregister <- client
+		client.evicted.Store(true)
+		select {
+		case h.unregister <- client:
+		case <-h.done:
+		}
+	} else if claimSession(&h.detachedDisplays, id) {
+		h.removeDisplay(id)
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -376,7 +707,13 @@ func (h *Hub) DeleteControllerHandler(w http.ResponseWriter, r *http.Request) {
 	id := vars["id"]
 	if c, ok := h.controllers.Load(id); ok {
 		client := c.(*Client)
-		h.unregister <- client
+		client.evicted.Store(true)
+		select {
+		case h.unregister <- client:
+		case <-h.done:
+		}
+	} else if claimSession(&h.detachedControllers, id) {
+		h.removeController(id)
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/simbafs/controly/server/internal/config"
+	"github.com/simbafs/controly/server/internal/domain"
+)
+
+func TestControllerSessionResumes(t *testing.T) {
+	commands := commandServer(t)
+	cfg := config.Default()
+	cfg.Timeouts.ControllerResumeGrace = time.Minute
+	hub := NewHub(cfg)
+	srv := serveHub(t, hub)
+
+	display := dialClient(t, wsURL(srv, "/ws?type=display&id=d1&command_url="+commands.URL), nil)
+	display.expect("set_id")
+	controller := dialClient(t, wsURL(srv, "/ws?type=controller&id=c1"), nil)
+	first := controller.expectSetID()
+	if first.Resumed || first.ResumeToken == "" {
+		t.Fatalf("new session: set_id = %+v", first)
+	}
+	controller.send(`{"type":"subscribe","payload":{"display_ids":["d1"]}}`)
+	controller.expect("command_list")
+	display.expect("subscribed")
+
+	// A connected session cannot be taken over without its resume token.
+	dialClient(t, wsURL(srv, "/ws?type=controller&id=c1"), nil).expectError(domain.ErrControllerIDConflict)
+
+	controller.conn.Close()
+	controller = dialClient(t, wsURL(srv, "/ws?type=controller&id=c1&resume_token="+first.ResumeToken), nil)
+	second := controller.expectSetID()
+	if !second.Resumed || second.ResumeToken == "" || second.ResumeToken == first.ResumeToken {
+		t.Fatalf("resumed session: set_id = %+v, want resumed with a new token", second)
+	}
+	if from := string(controller.expect("command_list")["from"]); from != `"d1"` {
+		t.Errorf("resumed session got command_list from %s, want d1", from)
+	}
+	display.send(`{"type":"status","payload":{"n":1}}`)
+	if got := string(controller.expect("status")["payload"]); got != `{"n":1}` {
+		t.Errorf("resumed session got status %s", got)
+	}
+
+	// A detached session is resumed without its token too, e.g. after a page
+	// reload.
+	controller.conn.Close()
+	waitFor(t, "the session to detach", func() bool { return contains(&hub.detachedControllers, "c1") })
+	controller = dialClient(t, wsURL(srv, "/ws?type=controller&id=c1"), nil)
+	if !controller.expectSetID().Resumed {
+		t.Error("reconnect without a token did not resume the detached session")
+	}
+	controller.expect("command_list")
+}
+
+func TestDisplaySessionResumes(t *testing.T) {
+	commands := commandServer(t)
+	cfg := config.Default()
+	cfg.Timeouts.DisplayResumeGrace = 500 * time.Millisecond
+	hub := NewHub(cfg)
+	srv := serveHub(t, hub)
+	displayURL := wsURL(srv, "/ws?type=display&id=d1&command_url="+commands.URL)
+
+	display := dialClient(t, displayURL, nil)
+	setID := display.expectSetID()
+	controller := dialClient(t, wsURL(srv, "/ws?type=controller&id=c1"), nil)
+	controller.expect("set_id")
+	controller.send(`{"type":"subscribe","payload":{"display_ids":["d1"]}}`)
+	controller.expect("command_list")
+	display.expect("subscribed")
+
+	// A connected display cannot be taken over without its resume token.
+	dialClient(t, displayURL, nil).expectError(domain.ErrDisplayIDConflict)
+
+	display.conn.Close()
+	display = dialClient(t, displayURL+"&resume_token="+setID.ResumeToken, nil)
+	if setID = display.expectSetID(); !setID.Resumed {
+		t.Fatal("reconnect with the resume token did not reattach the display")
+	}
+	if got := string(display.expect("subscribed")["payload"]); got != `{"count":1}` {
+		t.Errorf("reattached display got subscribed %s, want a count of 1", got)
+	}
+	controller.send(`{"type":"command","to":"d1","payload":{"name":"set_time","args":{"value":5}}}`)
+	display.expect("command")
+
+	// A detached display is reattached without its token too, e.g. after a
+	// page reload.
+	display.conn.Close()
+	waitFor(t, "the display to detach", func() bool { return contains(&hub.detachedDisplays, "d1") })
+	display = dialClient(t, displayURL, nil)
+	if setID = display.expectSetID(); !setID.Resumed {
+		t.Fatal("reconnect without a token did not reattach the detached display")
+	}
+	display.expect("subscribed")
+
+	// Once the grace period runs out, the subscribers wait for the display
+	// and it registers afresh.
+	display.conn.Close()
+	if got := string(controller.expect("display_disconnected")["payload"]); got != `{"display_id":"d1"}` {
+		t.Errorf("display_disconnected payload = %s", got)
+	}
+	display = dialClient(t, displayURL+"&resume_token="+setID.ResumeToken, nil)
+	if display.expectSetID().Resumed {
+		t.Error("display reattached after the grace period ran out")
+	}
+	controller.expect("command_list")
+}
+
+func TestSubscriberCountsWithConcurrentControllers(t *testing.T) {
+	commands := commandServer(t)
+	srv := serveHub(t, NewHub(config.Default()))
+	display := dialClient(t, wsURL(srv, "/ws?type=display&id=d1&command_url="+commands.URL), nil)
+	display.expect("set_id")
+
+	const n = 8
+	controllers := make([]*testClient, n)
+	for i := range controllers {
+		controllers[i] = dialClient(t, wsURL(srv, "/ws?type=controller"), nil)
+		controllers[i].expect("set_id")
+	}
+	// Each connection is handled on its own goroutine, so the counts are
+	// taken while other controllers change the subscribers.
+	for _, c := range controllers {
+		c.send(`{"type":"subscribe","payload":{"display_ids":["d1"]}}`)
+	}
+	for _, c := range controllers {
+		c.expect("command_list")
+	}
+	for _, c := range controllers {
+		c.send(`{"type":"unsubscribe","payload":{"display_ids":["d1"]}}`)
+	}
+
+	var payload domain.UnsubscribedPayload
+	for remaining := n; remaining > 0; remaining-- {
+		json.Unmarshal(display.expect("unsubscribed")["payload"], &payload)
+	}
+	if payload.Count != 0 {
+		t.Errorf("last unsubscribed count is %d, want 0", payload.Count)
+	}
+}
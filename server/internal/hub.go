@@ -2,29 +2,33 @@ package internal
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
+	"github.com/simbafs/controly/server/internal/codec"
+	"github.com/simbafs/controly/server/internal/config"
 	"github.com/simbafs/controly/server/internal/domain"
+	"github.com/simbafs/controly/server/internal/federation"
+	"github.com/simbafs/controly/server/internal/jwtauth"
+	"github.com/simbafs/controly/server/internal/logging"
+	"github.com/simbafs/controly/server/internal/origin"
+	"github.com/simbafs/controly/server/internal/store"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
-const (
-	writeWait      = 10 * time.Second
-	pongWait       = 60 * time.Second
-	pingPeriod     = (pongWait * 9) / 10
-	maxMessageSize = 512
-)
-
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins
-	},
-}
+// hotLog limits log lines that can be written for every message.
+var hotLog = logging.NewLimiter(time.Second, 10)
 
 // Client is a middleman between the websocket connection and the hub.
 type Client struct {
@@ -33,47 +37,95 @@ type Client struct {
 	send       chan []byte
 	id         string
 	clientType domain.ClientType
+	codec      codec.Codec // Wire encoding negotiated through the subprotocol
+	stats      *connStats
+	resumed    bool            // Whether this client took over a detached session
+	evicted    atomic.Bool     // Set when the client is removed through the REST API or for its rate limit
+	closeCode  int             // Close code sent when the send channel is closed, if not zero
+	log        *slog.Logger    // Logger with the client's ID, type and remote address
+	claims     *jwtauth.Claims // Token claims restricting the client, nil if unrestricted
+	expiry     *time.Timer     // Closes the connection when the token expires
+	limiter    *messageLimiter // Rate limits on the messages the client sends, nil if unlimited
 }
 
 // readPump pumps messages from the websocket connection to the hub.
 func (c *Client) readPump() {
 	defer func() {
-		c.hub.unregister <- c
+		select {
+		case c.hub.unregister <- c:
+		case <-c.hub.done:
+		}
+		if c.expiry != nil {
+			c.expiry.Stop()
+		}
 		c.conn.Close()
 	}()
-	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	c.conn.SetReadLimit(c.hub.maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(c.hub.pongWait))
+	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(c.hub.pongWait)); return nil })
 	for {
-		_, message, err := c.conn.ReadMessage()
+		frameType, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
+				c.log.Warn("Unexpected close", "error", err)
 			}
 			break
 		}
+		c.stats.messagesReceived.Add(1)
+		c.stats.bytesReceived.Add(uint64(len(message)))
+		bytesTotal.WithLabelValues(directionIn).Add(float64(len(message)))
+		if c.limiter != nil {
+			if limit := c.limiter.allow(len(message)); limit != "" {
+				if !c.overLimit(limit) {
+					break
+				}
+				continue
+			}
+		}
+		// Text frames are always JSON, so binary clients can still send JSON.
+		if frameType == websocket.BinaryMessage {
+			if message, err = c.codec.ToJSON(message); err != nil {
+				c.hub.sendError(c.id, domain.NewError(domain.ErrInvalidMessageFormat, "message is not valid %s: %v", c.codec.Name(), err))
+				continue
+			}
+		}
 		c.hub.handleMessage(c, message)
 	}
 }
 
 // writePump pumps messages from the hub to the websocket connection.
 func (c *Client) writePump() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(c.hub.pongWait * 9 / 10)
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+		c.hub.pumps.Done()
 	}()
 	for {
 		select {
 		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.SetWriteDeadline(time.Now().Add(c.hub.writeWait))
 			if !ok {
 				// The hub closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				closeMessage := []byte{}
+				if c.closeCode != 0 {
+					closeMessage = websocket.FormatCloseMessage(c.closeCode, "")
+				}
+				c.conn.WriteMessage(websocket.CloseMessage, closeMessage)
 				return
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
+			message, err := c.codec.FromJSON(message)
+			if err != nil {
+				c.log.Error("Error encoding message", "codec", c.codec.Name(), "error", err)
+				continue
+			}
+
+			if c.stats.compression {
+				// Compressing small messages costs more CPU than it saves bandwidth.
+				c.conn.EnableWriteCompression(len(message) >= c.stats.compressionThreshold)
+			}
+			w, err := c.conn.NextWriter(c.codec.FrameType())
 			if err != nil {
 				return
 			}
@@ -82,8 +134,11 @@ func (c *Client) writePump() {
 			if err := w.Close(); err != nil {
 				return
 			}
+			c.stats.messagesSent.Add(1)
+			c.stats.bytesSent.Add(uint64(len(message)))
+			bytesTotal.WithLabelValues(directionOut).Add(float64(len(message)))
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.SetWriteDeadline(time.Now().Add(c.hub.writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
@@ -103,24 +158,130 @@ type Hub struct {
 	register   chan *Client
 	unregister chan *Client
 
-	serverToken string
+	pumps          sync.WaitGroup // Running writePumps
+	shuttingDown   atomic.Bool
+	stopOnce       sync.Once
+	stop           chan struct{} // Closed to stop the Run loop
+	done           chan struct{} // Closed when the Run loop has stopped
+	reconnectDelay time.Duration
+
+	detachedDisplays    sync.Map // map[string]*detachedSession, displays that are reconnecting
+	detachedControllers sync.Map // map[string]*detachedSession, sessions waiting to be resumed
+
+	remoteDisplays    sync.Map // map[string]string, node ID of displays registered on other nodes
+	remoteControllers sync.Map // map[string]string, node ID of controllers on other nodes using local displays
+	broker            federation.Broker
+
+	store            store.Store
+	dirtyDisplays    sync.Map // map[string]struct{}, displays changed since the last flush
+	dirtyControllers sync.Map // map[string]struct{}, controllers changed since the last flush
+
+	pendingCommands sync.Map // map[string]*pendingCommand, keyed by the ID forwarded to the display
+	nextCommandID   atomic.Uint64
+
+	upgrader             websocket.Upgrader
+	origins              map[string]*origin.Allowlist // By client type; empty allows all origins
+	compressionLevel     int
+	compressionThreshold int
+	maxMessageSize       int64
+	sendBufferSize       int
+	writeWait            time.Duration
+	pongWait             time.Duration
+	conns                *connLimiter
+	rateLimits           map[domain.ClientType]config.RateConfig
+	maxViolations        int
+
+	serverToken           string
+	jwt                   *jwtauth.Verifier
+	allowQueryToken       bool
+	authTimeout           time.Duration
+	openRelay             bool
+	commandTimeout        time.Duration
+	displayResumeGrace    time.Duration
+	controllerResumeGrace time.Duration
+	restoreGrace          time.Duration
 }
 
-func NewHub(serverToken string) *Hub {
-	return &Hub{
-		register:    make(chan *Client),
-		unregister:  make(chan *Client),
-		serverToken: serverToken,
+func NewHub(cfg *config.Config) *Hub {
+	h := &Hub{
+		origins:               make(map[string]*origin.Allowlist),
+		compressionLevel:      cfg.Compression.Level,
+		compressionThreshold:  cfg.Compression.Threshold,
+		maxMessageSize:        cfg.Limits.MaxMessageSize,
+		sendBufferSize:        cfg.Limits.SendBufferSize,
+		writeWait:             cfg.Timeouts.Write,
+		pongWait:              cfg.Timeouts.Pong,
+		conns:                 newConnLimiter(cfg.Limits),
+		rateLimits:            make(map[domain.ClientType]config.RateConfig),
+		maxViolations:         cfg.Limits.MaxViolations,
+		register:              make(chan *Client),
+		unregister:            make(chan *Client),
+		stop:                  make(chan struct{}),
+		done:                  make(chan struct{}),
+		reconnectDelay:        cfg.Timeouts.ReconnectDelay,
+		serverToken:           cfg.Auth.Token,
+		allowQueryToken:       cfg.Auth.AllowQueryToken,
+		authTimeout:           cfg.Timeouts.Auth,
+		openRelay:             cfg.OpenRelay,
+		commandTimeout:        cfg.Timeouts.Command,
+		displayResumeGrace:    cfg.Timeouts.DisplayResumeGrace,
+		controllerResumeGrace: cfg.Timeouts.ControllerResumeGrace,
+		restoreGrace:          cfg.Timeouts.RestoreGrace,
+	}
+	// The lists were checked when the configuration was validated.
+	h.origins["unknown"], _ = origin.New(cfg.Origins.Allowed)
+	for _, ct := range []domain.ClientType{domain.ClientTypeDisplay, domain.ClientTypeController, domain.ClientTypeInspector} {
+		h.origins[ct.String()], _ = origin.New(cfg.Origins.ForClient(ct.String()))
+	}
+	// Inspectors send nothing worth limiting; the hub ignores their messages.
+	h.rateLimits[domain.ClientTypeDisplay] = cfg.Limits.Display
+	h.rateLimits[domain.ClientTypeController] = cfg.Limits.Controller
+	h.upgrader = websocket.Upgrader{
+		ReadBufferSize:    cfg.Limits.ReadBufferSize,
+		WriteBufferSize:   cfg.Limits.WriteBufferSize,
+		Subprotocols:      codec.Subprotocols(),
+		EnableCompression: cfg.Compression.Enabled,
+		// Origins are checked per client type before upgrading.
+		CheckOrigin: func(*http.Request) bool { return true },
+	}
+	return h
+}
+
+// checkOrigin accepts requests without an Origin header, such as those from
+// native clients, and browsers on an origin allowed for the client type.
+// Pages served by the relay itself are not exempt. Rejections are counted.
+func (h *Hub) checkOrigin(r *http.Request, clientType string) bool {
+	allowed := h.origins[clientType]
+	o := r.Header.Get("Origin")
+	if allowed.Empty() || o == "" || allowed.Allows(o) {
+		return true
+	}
+	rejectedOriginsTotal.WithLabelValues(clientType).Inc()
+	return false
+}
+
+// clientTypeLabel bounds a client type taken from a request to the known
+// types, for use in metrics.
+func clientTypeLabel(clientType string) string {
+	switch clientType {
+	case "display", "controller", "inspector":
+		return clientType
+	default:
+		return "unknown"
 	}
 }
 
 func (h *Hub) Run() {
+	defer close(h.done)
 	for {
 		select {
 		case client := <-h.register:
 			h.registerClient(client)
 		case client := <-h.unregister:
 			h.unregisterClient(client)
+		case <-h.stop:
+			h.closeAll()
+			return
 		}
 	}
 }
@@ -128,46 +289,200 @@ func (h *Hub) Run() {
 func (h *Hub) registerClient(client *Client) {
 	switch client.clientType {
 	case domain.ClientTypeDisplay:
-		h.displays.Store(client.id, client)
+		if old, ok := h.displays.Swap(client.id, client); ok {
+			// A resumed session replaces a connection that has not timed out yet.
+			close(old.(*Client).send)
+			client.log.Info("Display connection taken over")
+		} else {
+			connectedClients.WithLabelValues(client.clientType.String()).Inc()
+		}
 	case domain.ClientTypeController:
-		h.controllers.Store(client.id, client)
+		if old, ok := h.controllers.Swap(client.id, client); ok {
+			close(old.(*Client).send)
+			client.log.Info("Controller connection taken over")
+		} else {
+			connectedClients.WithLabelValues(client.clientType.String()).Inc()
+		}
 	case domain.ClientTypeInspector:
 		h.inspectors.Store(client.id, client)
+		connectedClients.WithLabelValues(client.clientType.String()).Inc()
 	}
-	log.Printf("Client registered: %s (%s)", client.id, client.clientType)
-	if client.clientType != domain.ClientTypeInspector {
-		h.send(client.id, "server", "set_id", domain.SetIDPayload{
-			ID: client.id,
-		})
+	client.log.Info("Client registered", "resumed", client.resumed)
+	switch client.clientType {
+	case domain.ClientTypeDisplay:
+		payload := domain.SetIDPayload{
+			ID:      client.id,
+			Resumed: client.resumed,
+		}
+		if d, ok := h.displayEntities.Load(client.id); ok {
+			display := d.(*domain.Display)
+			display.Mu.Lock()
+			payload.ResumeToken = display.ResumeToken
+			display.Mu.Unlock()
+		}
+		h.send(client.id, "server", "set_id", payload)
+		if client.resumed {
+			h.restoreDisplaySession(client.id)
+		}
+	case domain.ClientTypeController:
+		payload := domain.SetIDPayload{
+			ID:      client.id,
+			Resumed: client.resumed,
+		}
+		if c, ok := h.controllerEntities.Load(client.id); ok {
+			controller := c.(*domain.Controller)
+			controller.Mu.Lock()
+			payload.ResumeToken = controller.ResumeToken
+			controller.Mu.Unlock()
+		}
+		h.send(client.id, "server", "set_id", payload)
+		if client.resumed {
+			h.restoreControllerSession(client.id)
+		}
 	}
 }
 
 func (h *Hub) unregisterClient(client *Client) {
 	switch client.clientType {
 	case domain.ClientTypeDisplay:
-		h.displays.Delete(client.id)
-		h.displayEntities.Delete(client.id)
-		h.handleDisplayDisconnection(client.id)
-		log.Printf("Display unregistered and removed: %s", client.id)
+		// The client may already have been unregistered, e.g. through the REST API.
+		if !h.displays.CompareAndDelete(client.id, client) {
+			return
+		}
+		if client.evicted.Load() || h.displayResumeGrace <= 0 {
+			h.removeDisplay(client.id)
+			client.log.Info("Display unregistered and removed")
+		} else {
+			id := client.id
+			detachSession(&h.detachedDisplays, id, h.displayResumeGrace, func() {
+				h.removeDisplay(id)
+				client.log.Info("Display did not reconnect in time and was removed")
+			})
+			client.log.Info("Display unregistered, reconnecting", "grace", h.displayResumeGrace)
+		}
 	case domain.ClientTypeController:
-		h.controllers.Delete(client.id)
-		h.controllerEntities.Delete(client.id)
-		h.handleControllerDisconnection(client.id)
-		log.Printf("Controller unregistered and removed: %s", client.id)
+		if !h.controllers.CompareAndDelete(client.id, client) {
+			return
+		}
+		if client.evicted.Load() || h.controllerResumeGrace <= 0 {
+			h.removeController(client.id)
+			client.log.Info("Controller unregistered and removed")
+		} else {
+			id := client.id
+			detachSession(&h.detachedControllers, id, h.controllerResumeGrace, func() {
+				h.removeController(id)
+				client.log.Info("Controller session expired and removed")
+			})
+			client.log.Info("Controller unregistered, session kept", "grace", h.controllerResumeGrace)
+		}
 	case domain.ClientTypeInspector:
-		h.inspectors.Delete(client.id)
-		log.Printf("Inspector unregistered and removed: %s", client.id)
+		if !h.inspectors.CompareAndDelete(client.id, client) {
+			return
+		}
+		client.log.Info("Inspector unregistered and removed")
 	}
+	connectedClients.WithLabelValues(client.clientType.String()).Dec()
 	close(client.send)
 }
 
+// detachedSession is the session of a disconnected client that expires when
+// its timer fires, unless it is claimed first.
+type detachedSession struct {
+	timer *time.Timer
+}
+
+// detachSession keeps the session of a disconnected client in sessions until
+// grace runs out, then calls expire.
+func detachSession(sessions *sync.Map, id string, grace time.Duration, expire func()) {
+	s := &detachedSession{}
+	s.timer = time.AfterFunc(grace, func() {
+		if sessions.CompareAndDelete(id, s) {
+			expire()
+		}
+	})
+	sessions.Store(id, s)
+}
+
+// claimSession stops the expiry of a detached session. It returns false if the
+// session is not detached or has already expired.
+func claimSession(sessions *sync.Map, id string) bool {
+	s, ok := sessions.LoadAndDelete(id)
+	if !ok {
+		return false
+	}
+	s.(*detachedSession).timer.Stop()
+	return true
+}
+
+// removeController drops a controller's session and its subscriptions.
+func (h *Hub) removeController(controllerID string) {
+	h.handleControllerDisconnection(controllerID)
+	h.controllerEntities.Delete(controllerID)
+	h.touchController(controllerID)
+}
+
+// removeDisplay drops a display and moves its subscribers to waiting.
+func (h *Hub) removeDisplay(displayID string) {
+	d, ok := h.displayEntities.LoadAndDelete(displayID)
+	if !ok {
+		return
+	}
+	h.touchDisplay(displayID)
+	h.announce(&federation.Envelope{Type: federation.TypeDisplayDown, Display: displayID})
+	h.handleDisplayDisconnection(displayID)
+
+	display := d.(*domain.Display)
+	display.Mu.Lock()
+	subscribers := make([]string, 0, len(display.Subscribers))
+	for id := range display.Subscribers {
+		subscribers = append(subscribers, id)
+	}
+	display.Mu.Unlock()
+	for _, id := range subscribers {
+		if _, ok := h.remoteControllers.Load(id); ok {
+			h.forgetRemoteController(id)
+		}
+	}
+}
+
+// startClient registers a client and starts its pumps. It returns false if
+// the hub has stopped in the meantime.
+func (h *Hub) startClient(client *Client) bool {
+	h.pumps.Add(1)
+	select {
+	case h.register <- client:
+	case <-h.done:
+		h.pumps.Done()
+		client.conn.Close()
+		return false
+	}
+	h.expireWithToken(client)
+	go client.writePump()
+	go client.readPump()
+	return true
+}
+
 func (h *Hub) handleMessage(client *Client, message []byte) {
+	if h.shuttingDown.Load() {
+		return
+	}
+	if client.clientType == domain.ClientTypeInspector {
+		return
+	}
+
 	var msg domain.IncomingMessage
 	if err := json.Unmarshal(message, &msg); err != nil {
-		log.Printf("Error unmarshalling message from %s: %v", client.id, err)
+		hotLog.Log(client.log, slog.LevelWarn, "invalid_message", "Invalid message", "error", err)
+		h.sendError(client.id, domain.NewError(domain.ErrInvalidMessageFormat, "message is not valid JSON"))
+		return
+	}
+	if msg.Type == "" {
+		h.sendError(client.id, domain.NewError(domain.ErrInvalidMessageFormat, "message is missing required field: type"))
 		return
 	}
 
+	countMessage(msg.Type, directionIn)
+
 	switch client.clientType {
 	case domain.ClientTypeDisplay:
 		h.handleDisplayMessage(client, &msg)
@@ -176,15 +491,33 @@ func (h *Hub) handleMessage(client *Client, message []byte) {
 	}
 }
 
+// clientLog returns the logger of a connected client, or a logger with just
+// the client ID if it is not connected.
+func (h *Hub) clientLog(id string) *slog.Logger {
+	if c, ok := h.displays.Load(id); ok {
+		return c.(*Client).log
+	}
+	if c, ok := h.controllers.Load(id); ok {
+		return c.(*Client).log
+	}
+	return slog.With("client_id", id)
+}
+
 func (h *Hub) send(to, from, msgType string, payload any) {
 	payloadBytes, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("Error marshalling payload for type '%s': %v", msgType, err)
+		slog.Error("Error marshalling payload", "type", msgType, "error", err)
 		return
 	}
 	h.sendRaw(to, from, msgType, payloadBytes)
 }
 
+// sendError reports err to a registered client as an 'error' message.
+func (h *Hub) sendError(to string, err error) {
+	hotLog.Log(h.clientLog(to), slog.LevelInfo, "client_error", "Sending error", "error", err)
+	h.send(to, "server", "error", toDomainError(err).Payload())
+}
+
 func (h *Hub) sendRaw(to, from, msgType string, payload json.RawMessage) {
 	h.broadcast([]string{to}, from, msgType, payload)
 }
@@ -195,23 +528,37 @@ func (h *Hub) broadcast(targets []string, from, msgType string, payload any) {
 	}
 	payloadBytes, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("Error marshalling broadcast payload: %v", err)
+		slog.Error("Error marshalling broadcast payload", "type", msgType, "error", err)
 		return
 	}
-	msg := domain.OutgoingMessage{
+	h.deliver(targets, domain.OutgoingMessage{
 		Type:    msgType,
 		From:    from,
 		Payload: payloadBytes,
-	}
+	})
+}
+
+// deliver marshals msg once and queues it on the send channel of every target.
+func (h *Hub) deliver(targets []string, msg domain.OutgoingMessage) {
 	msgBytes, err := json.Marshal(msg)
 	if err != nil {
-		log.Printf("Error marshalling outgoing message for broadcast: %v", err)
+		slog.Error("Error marshalling outgoing message", "type", msg.Type, "error", err)
 		return
 	}
 
+	h.deliverBytes(msg.From, msg.Type, targets, msgBytes, true)
+}
+
+// deliverBytes queues an encoded message for each target. When forward is set,
+// targets that are controllers on other nodes are sent there.
+func (h *Hub) deliverBytes(from, msgType string, targets []string, msgBytes []byte, forward bool) {
 	// Forward outgoing broadcast to inspector
 	h.broadcastToInspectors(from, targets, msgBytes)
+	if forward {
+		fanoutSize.Observe(float64(len(targets)))
+	}
 
+	var remote map[string][]string // Target IDs by node
 	for _, targetID := range targets {
 		var targetClient *Client
 		if c, ok := h.displays.Load(targetID); ok {
@@ -223,13 +570,24 @@ func (h *Hub) broadcast(targets []string, from, msgType string, payload any) {
 		if targetClient != nil {
 			select {
 			case targetClient.send <- msgBytes:
+				countMessage(msgType, directionOut)
 			default:
-				log.Printf("Send channel full for client %s, message dropped.", targetID)
+				droppedMessagesTotal.WithLabelValues(targetClient.clientType.String()).Inc()
+				hotLog.Log(targetClient.log, slog.LevelWarn, "send_channel_full", "Send channel full, message dropped", "type", msgType)
+			}
+		} else if node, ok := h.remoteControllers.Load(targetID); ok && forward {
+			if remote == nil {
+				remote = make(map[string][]string)
 			}
+			remote[node.(string)] = append(remote[node.(string)], targetID)
 		} else {
-			log.Printf("Client %s not found for sending message.", targetID)
+			hotLog.Log(slog.Default(), slog.LevelDebug, "target_not_found", "Client not found for sending message", "client_id", targetID, "type", msgType)
 		}
 	}
+
+	for node, ids := range remote {
+		h.federate(node, &federation.Envelope{Type: federation.TypeDeliver, Targets: ids, Message: msgBytes})
+	}
 }
 
 func (h *Hub) isInspectorConnected() bool {
@@ -252,7 +610,7 @@ func (h *Hub) broadcastToInspectors(source string, targets []string, originalMes
 		// Not a valid JSON, treat as a raw string and marshal it into a JSON string value.
 		quoted, wrapErr := json.Marshal(string(originalMessage))
 		if wrapErr != nil {
-			log.Printf("Error wrapping non-JSON message for inspector: %v", wrapErr)
+			slog.Error("Error wrapping non-JSON message for inspector", "error", wrapErr)
 		} else {
 			msgToSend = quoted
 		}
@@ -267,7 +625,7 @@ func (h *Hub) broadcastToInspectors(source string, targets []string, originalMes
 
 	messageBytes, err := json.Marshal(inspectionMessage)
 	if err != nil {
-		log.Printf("Error marshalling inspection message: %v", err)
+		slog.Error("Error marshalling inspection message", "error", err)
 		return
 	}
 
@@ -276,62 +634,220 @@ func (h *Hub) broadcastToInspectors(source string, targets []string, originalMes
 		select {
 		case client.send <- messageBytes:
 		default:
-			log.Printf("Inspector send channel full for client %s, message dropped.", client.id)
+			droppedMessagesTotal.WithLabelValues(client.clientType.String()).Inc()
+			hotLog.Log(client.log, slog.LevelWarn, "inspector_channel_full", "Inspector send channel full, message dropped")
 		}
 		return true
 	})
 }
 
+// upgrade upgrades an HTTP request to a WebSocket connection whose traffic is
+// counted in the returned stats. The connection holds one of the slots capped
+// by the connection limits until it is closed.
+func (h *Hub) upgrade(w http.ResponseWriter, r *http.Request, clientType string) (*websocket.Conn, *connStats, error) {
+	clientType = clientTypeLabel(clientType)
+	if h.shuttingDown.Load() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return nil, nil, errors.New("rejected upgrade: server is shutting down")
+	}
+	if !h.checkOrigin(r, clientType) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return nil, nil, fmt.Errorf("rejected upgrade: origin %q is not allowed", r.Header.Get("Origin"))
+	}
+	ip := remoteIP(r)
+	if limit := h.conns.acquire(ip); limit != "" {
+		rateLimitedTotal.WithLabelValues(clientType, limit).Inc()
+		if limit == limitMaxClients {
+			http.Error(w, "too many clients", http.StatusServiceUnavailable)
+		} else {
+			http.Error(w, "too many connections", http.StatusTooManyRequests)
+		}
+		return nil, nil, fmt.Errorf("rejected upgrade: %s limit reached", limit)
+	}
+	release := sync.OnceFunc(func() { h.conns.release(ip) })
+
+	stats := &connStats{}
+	conn, err := h.upgrader.Upgrade(&statsResponseWriter{ResponseWriter: w, stats: stats, onClose: release}, r, nil)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	// Do not count the handshake.
+	stats.wireBytesSent.Store(0)
+	stats.wireBytesReceived.Store(0)
+
+	if h.upgrader.EnableCompression && offersDeflate(r) {
+		stats.compression = true
+		stats.compressionThreshold = h.compressionThreshold
+		conn.SetCompressionLevel(h.compressionLevel)
+	}
+	return conn, stats, nil
+}
+
 func (h *Hub) ServeWs(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "ws.register", trace.WithAttributes(attribute.String("controly.client_type", r.URL.Query().Get("type"))))
+	defer span.End()
+	logger := slog.With("client_type", r.URL.Query().Get("type"), "remote_addr", r.RemoteAddr)
+
+	conn, stats, err := h.upgrade(w, r, r.URL.Query().Get("type"))
 	if err != nil {
-		log.Println(err)
+		recordError(span, err)
+		logger.Warn("WebSocket upgrade failed", "error", err)
 		return
 	}
+	reject := func(err error) {
+		recordError(span, err)
+		h.rejectConn(conn, err)
+	}
+
+	// A client can move its own threshold, e.g. lower on a metered link.
+	if threshold := r.URL.Query().Get("compression_threshold"); threshold != "" {
+		n, err := strconv.Atoi(threshold)
+		if err != nil || n < 0 {
+			reject(domain.NewError(domain.ErrInvalidQueryParams, "compression_threshold must be a non-negative integer"))
+			return
+		}
+		stats.compressionThreshold = n
+	}
 
 	clientTypeStr := r.URL.Query().Get("type")
 	var clientID string
 	var clientTypeEnum domain.ClientType
+	var resumed bool
+	var claims *jwtauth.Claims
 
 	switch clientTypeStr {
 	case "display":
 		clientTypeEnum = domain.ClientTypeDisplay
 		displayIDParam := r.URL.Query().Get("id")
 		commandURL := r.URL.Query().Get("command_url")
-		token := r.URL.Query().Get("token")
-		clientID, err = h.handleNewDisplay(displayIDParam, commandURL, token)
+		resumeToken := r.URL.Query().Get("resume_token")
+		var displayID string
+		displayID, claims, err = h.authorizeDisplay(r, conn, displayIDParam)
+		if err == nil {
+			clientID, resumed, err = h.handleNewDisplay(ctx, displayID, commandURL, resumeToken)
+		}
 		if err != nil {
-			log.Printf("Display registration failed: %v", err)
-			conn.Close()
+			logger.Info("Display registration failed", "client_id", displayIDParam, "error", err)
+			reject(err)
 			return
 		}
+		h.touchDisplay(clientID)
 	case "controller":
 		clientTypeEnum = domain.ClientTypeController
-		clientID, err = h.handleNewController()
+		controllerIDParam := r.URL.Query().Get("id")
+		resumeToken := r.URL.Query().Get("resume_token")
+		statusMode := r.URL.Query().Get("status_mode")
+		if statusMode != "" && statusMode != "full" && statusMode != "patch" {
+			reject(domain.NewError(domain.ErrInvalidQueryParams, "status_mode must be full or patch"))
+			return
+		}
+		claims, err = h.authorizeController(r, conn)
+		if err == nil {
+			clientID, resumed, err = h.handleNewController(controllerIDParam, resumeToken)
+		}
 		if err != nil {
-			log.Printf("Controller registration failed: %v", err)
-			conn.Close()
+			logger.Info("Controller registration failed", "client_id", controllerIDParam, "error", err)
+			reject(err)
 			return
 		}
+		if c, ok := h.controllerEntities.Load(clientID); ok {
+			c.(*domain.Controller).SetStatusPatches(statusMode == "patch")
+		}
+		h.touchController(clientID)
+	case "":
+		reject(domain.NewError(domain.ErrInvalidQueryParams, "request is missing required query parameter: type"))
+		return
 	default:
-		log.Println("Invalid client type")
-		conn.Close()
+		logger.Info("Invalid client type")
+		reject(domain.NewError(domain.ErrInvalidClientType, "invalid client type: %s", clientTypeStr))
 		return
 	}
 
+	span.SetAttributes(attribute.String("controly.client_id", clientID), attribute.Bool("controly.resumed", resumed))
+
 	client := &Client{
 		hub:        h,
 		conn:       conn,
-		send:       make(chan []byte, 256),
+		send:       make(chan []byte, h.sendBufferSize),
 		id:         clientID,
 		clientType: clientTypeEnum,
+		codec:      codec.Lookup(conn.Subprotocol()),
+		stats:      stats,
+		resumed:    resumed,
+		log:        logger.With("client_id", clientID),
+		claims:     claims,
+		limiter:    h.newMessageLimiter(clientTypeEnum),
+	}
+	if !h.startClient(client) {
+		return
 	}
-	h.register <- client
-
-	go client.writePump()
-	go client.readPump()
 
 	if clientTypeEnum == domain.ClientTypeDisplay {
-		h.postDisplayRegistration(clientID)
+		h.postDisplayRegistration(ctx, clientID)
+	}
+}
+
+// rejectConn sends err as an 'error' message to a connection that has not been
+// registered with the hub, then closes it with a matching close code.
+func (h *Hub) rejectConn(conn *websocket.Conn, err error) {
+	defer conn.Close()
+
+	e := toDomainError(err)
+
+	payload, _ := json.Marshal(e.Payload())
+	msg, _ := json.Marshal(domain.OutgoingMessage{
+		Type:    "error",
+		From:    "server",
+		Payload: payload,
+	})
+
+	c := codec.Lookup(conn.Subprotocol())
+	if encoded, err := c.FromJSON(msg); err == nil {
+		conn.SetWriteDeadline(time.Now().Add(h.writeWait))
+		if err := conn.WriteMessage(c.FrameType(), encoded); err != nil {
+			return
+		}
+	}
+
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode(e.Code), closeReason(e.Message)))
+}
+
+// toDomainError returns err as a *domain.Error, hiding errors that do not carry
+// an error code behind a generic internal error.
+func toDomainError(err error) *domain.Error {
+	var e *domain.Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return domain.NewError(domain.ErrInternalServer, "internal server error")
+}
+
+// closeReason truncates message to the 123 bytes the WebSocket protocol allows
+// in a close reason, without splitting a UTF-8 sequence.
+func closeReason(message string) string {
+	const maxLen = 123
+	if len(message) <= maxLen {
+		return message
+	}
+	n := maxLen
+	for n > 0 && !utf8.RuneStart(message[n]) {
+		n--
+	}
+	return message[:n]
+}
+
+// closeCode maps an error code from the domain package to a WebSocket close code.
+func closeCode(code int) int {
+	switch code {
+	case domain.ErrInternalServer:
+		return websocket.CloseInternalServerErr
+	case domain.ErrCommandURLUnreachable:
+		return websocket.CloseTryAgainLater
+	case domain.ErrInvalidMessageFormat, domain.ErrInvalidCommandFormat:
+		return websocket.CloseUnsupportedData
+	default:
+		return websocket.ClosePolicyViolation
 	}
 }
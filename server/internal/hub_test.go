@@ -0,0 +1,225 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"github.com/simbafs/controly/server/internal/config"
+	"github.com/simbafs/controly/server/internal/domain"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const testCommands = `[{"name":"set_time","label":"Set Time","type":"number","min":1,"max":3600,"step":1}]`
+
+// commandServer serves testCommands as the command.json of test displays.
+func commandServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testCommands))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// serveHub runs hub behind a test server until the test ends.
+func serveHub(t *testing.T, hub *Hub) *httptest.Server {
+	t.Helper()
+	go hub.Run()
+	srv := httptest.NewServer(http.HandlerFunc(hub.ServeWs))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		hub.Shutdown(ctx)
+		srv.Close()
+	})
+	return srv
+}
+
+func wsURL(srv *httptest.Server, path string) string {
+	return "ws://" + srv.Listener.Addr().String() + path
+}
+
+// testClient reads the messages of a WebSocket client in the background.
+type testClient struct {
+	t        *testing.T
+	conn     *websocket.Conn
+	messages chan map[string]json.RawMessage
+}
+
+func dialClient(t *testing.T, url string, header http.Header) *testClient {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("dial %s: %v", url, err)
+	}
+	return newTestClient(t, conn)
+}
+
+// newTestClient starts reading the messages of conn, which it closes when the
+// test ends.
+func newTestClient(t *testing.T, conn *websocket.Conn) *testClient {
+	t.Cleanup(func() { conn.Close() })
+	c := &testClient{t: t, conn: conn, messages: make(chan map[string]json.RawMessage, 64)}
+	go func() {
+		defer close(c.messages)
+		for {
+			var msg map[string]json.RawMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			c.messages <- msg
+		}
+	}()
+	return c
+}
+
+func (c *testClient) send(msg string) {
+	c.t.Helper()
+	if err := c.conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		c.t.Fatalf("send: %v", err)
+	}
+}
+
+// expect skips messages until one of type msgType arrives and returns it.
+func (c *testClient) expect(msgType string) map[string]json.RawMessage {
+	c.t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg, ok := <-c.messages:
+			if !ok {
+				c.t.Fatalf("connection closed while waiting for %s", msgType)
+			}
+			var got string
+			json.Unmarshal(msg["type"], &got)
+			if got == "error" && msgType != "error" {
+				c.t.Fatalf("got error while waiting for %s: %s", msgType, msg["payload"])
+			}
+			if got == msgType {
+				return msg
+			}
+		case <-timeout:
+			c.t.Fatalf("timed out waiting for %s", msgType)
+		}
+	}
+}
+
+// expectSetID waits for the set_id message and returns its payload.
+func (c *testClient) expectSetID() domain.SetIDPayload {
+	c.t.Helper()
+	var payload domain.SetIDPayload
+	if err := json.Unmarshal(c.expect("set_id")["payload"], &payload); err != nil {
+		c.t.Fatalf("set_id payload: %v", err)
+	}
+	return payload
+}
+
+// expectError waits for an error message and checks its code.
+func (c *testClient) expectError(code int) {
+	c.t.Helper()
+	var payload domain.ErrorPayload
+	json.Unmarshal(c.expect("error")["payload"], &payload)
+	if payload.Code != code {
+		c.t.Errorf("got error %d (%s), want %d", payload.Code, payload.Message, code)
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	tests := []struct {
+		message string
+		wantLen int
+	}{
+		{"short", 5},
+		{strings.Repeat("a", 123), 123},
+		{strings.Repeat("a", 200), 123},
+		// A three-byte rune would straddle the limit at bytes 122 to 124.
+		{strings.Repeat("a", 122) + "時間", 122},
+		{strings.Repeat("a", 120) + "時間", 123},
+	}
+	for _, tt := range tests {
+		got := closeReason(tt.message)
+		if len(got) != tt.wantLen || !utf8.ValidString(got) || !strings.HasPrefix(tt.message, got) {
+			t.Errorf("closeReason(%q) = %q (%d bytes), want a valid prefix of %d bytes", tt.message, got, len(got), tt.wantLen)
+		}
+	}
+}
+
+func TestMsgpackControllerCommandsJSONDisplay(t *testing.T) {
+	commands := commandServer(t)
+	srv := serveHub(t, NewHub(config.Default()))
+	display := dialClient(t, wsURL(srv, "/ws?type=display&id=d1&command_url="+commands.URL), nil)
+	display.expect("set_id")
+
+	dialer := websocket.Dialer{Subprotocols: []string{"controly.msgpack.v1"}}
+	conn, _, err := dialer.Dial(wsURL(srv, "/ws?type=controller&id=c1"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != "controly.msgpack.v1" {
+		t.Fatalf("negotiated subprotocol %q", conn.Subprotocol())
+	}
+	send := func(msg map[string]any) {
+		t.Helper()
+		data, err := msgpack.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(msgType string) map[string]any {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			frameType, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("waiting for %s: %v", msgType, err)
+			}
+			if frameType != websocket.BinaryMessage {
+				t.Fatalf("got a text frame for a msgpack client: %s", data)
+			}
+			var msg map[string]any
+			if err := msgpack.Unmarshal(data, &msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg["type"] == msgType {
+				return msg
+			}
+		}
+	}
+
+	expect("set_id")
+	send(map[string]any{"type": "subscribe", "payload": map[string]any{"display_ids": []string{"d1"}}})
+	expect("command_list")
+	send(map[string]any{"type": "command", "to": "d1", "payload": map[string]any{"name": "set_time", "args": map[string]any{"value": uint16(60)}}})
+	if got := string(display.expect("command")["payload"]); got != `{"args":{"value":60},"name":"set_time"}` {
+		t.Errorf("display got command %s", got)
+	}
+
+	display.send(`{"type":"status","payload":{"big":18446744073709551615,"ratio":0.5}}`)
+	status := expect("status")["payload"].(map[string]any)
+	if status["big"] != uint64(18446744073709551615) || status["ratio"] != 0.5 {
+		t.Errorf("controller got status %#v", status)
+	}
+}
@@ -0,0 +1,114 @@
+// Package jwtauth verifies the signed tokens clients authenticate with.
+package jwtauth
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Roles a token can be issued for.
+const (
+	RoleDisplay    = "display"
+	RoleController = "controller"
+	RoleInspector  = "inspector"
+)
+
+// AllDisplays in Claims.Displays allows every display.
+const AllDisplays = "*"
+
+// Claims are the claims of a client token. The registered "exp" claim is
+// required and ends the client's connection when it passes.
+type Claims struct {
+	jwt.RegisteredClaims
+	// Role is the client type the token is valid for.
+	Role string `json:"role"`
+	// Displays are the display IDs a display may register as, or the displays a
+	// controller may subscribe to and command.
+	Displays []string `json:"displays,omitempty"`
+	// ReadOnly limits a controller to receiving command lists and status; it
+	// may not send commands.
+	ReadOnly bool `json:"read_only,omitempty"`
+}
+
+// AllowsDisplay reports whether the claims cover a display ID.
+func (c *Claims) AllowsDisplay(id string) bool {
+	return slices.Contains(c.Displays, AllDisplays) || slices.Contains(c.Displays, id)
+}
+
+// Verifier verifies tokens signed with HS256 using a shared secret, or with
+// EdDSA using an Ed25519 key pair.
+type Verifier struct {
+	secret    []byte
+	publicKey ed25519.PublicKey
+	parser    *jwt.Parser
+}
+
+// NewVerifier creates a Verifier for the configured keys. publicKeyFile is a
+// PEM file with an Ed25519 public key. Either may be empty, but not both.
+func NewVerifier(secret, publicKeyFile string) (*Verifier, error) {
+	v := &Verifier{secret: []byte(secret)}
+	var methods []string
+	if secret != "" {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	if publicKeyFile != "" {
+		key, err := loadPublicKey(publicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		v.publicKey = key
+		methods = append(methods, jwt.SigningMethodEdDSA.Alg())
+	}
+	if len(methods) == 0 {
+		return nil, errors.New("no JWT key configured")
+	}
+	v.parser = jwt.NewParser(jwt.WithValidMethods(methods), jwt.WithExpirationRequired())
+	return v, nil
+}
+
+// Verify checks a token's signature and lifetime and returns its claims.
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := v.parser.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		if t.Method == jwt.SigningMethodEdDSA {
+			return v.publicKey, nil
+		}
+		return v.secret, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch claims.Role {
+	case RoleDisplay, RoleController, RoleInspector:
+	default:
+		return nil, fmt.Errorf("invalid role %q", claims.Role)
+	}
+	return claims, nil
+}
+
+func loadPublicKey(file string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading JWT public key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", file)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing JWT public key: %w", err)
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("JWT public key in %s is not an Ed25519 key", file)
+	}
+	return edKey, nil
+}
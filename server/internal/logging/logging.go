@@ -0,0 +1,95 @@
+// Package logging configures the server's structured logger.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Setup installs the default slog logger. level is one of debug, info, warn
+// or error, and format is text or json. Empty values select info and text.
+func Setup(level, format string) error {
+	var lvl slog.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return fmt.Errorf("invalid log level %q", level)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid log format %q", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// Limiter rate-limits log lines in hot paths, such as one line per dropped
+// message. Each key may log burst lines per interval; the first line logged
+// after that reports how many were suppressed.
+type Limiter struct {
+	interval time.Duration
+	burst    int
+
+	mu      sync.Mutex
+	windows map[string]*window
+}
+
+type window struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+// NewLimiter creates a Limiter.
+func NewLimiter(interval time.Duration, burst int) *Limiter {
+	return &Limiter{interval: interval, burst: burst, windows: make(map[string]*window)}
+}
+
+// Allow reports whether a line for key may be logged, and how many lines for
+// key were suppressed since the last one that was.
+func (l *Limiter) Allow(key string) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	w, ok := l.windows[key]
+	if !ok {
+		w = &window{start: now}
+		l.windows[key] = w
+	}
+	if now.Sub(w.start) >= l.interval {
+		w.start = now
+		w.count = 0
+	}
+	if w.count >= l.burst {
+		w.suppressed++
+		return false, 0
+	}
+	w.count++
+	suppressed := w.suppressed
+	w.suppressed = 0
+	return true, suppressed
+}
+
+// Log logs through logger if the Limiter allows a line for key.
+func (l *Limiter) Log(logger *slog.Logger, level slog.Level, key, msg string, args ...any) {
+	ok, suppressed := l.Allow(key)
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		args = append(args, "suppressed", suppressed)
+	}
+	logger.Log(context.Background(), level, msg, args...)
+}
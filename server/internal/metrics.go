@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	connectedClients = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "controly",
+		Name:      "connected_clients",
+		Help:      "Number of connected clients by type.",
+	}, []string{"client_type"})
+
+	messagesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "controly",
+		Name:      "messages_total",
+		Help:      "Messages received from and queued for clients, by message type and direction.",
+	}, []string{"type", "direction"})
+
+	bytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "controly",
+		Name:      "bytes_total",
+		Help:      "Message payload bytes received from and sent to clients, by direction.",
+	}, []string{"direction"})
+
+	droppedMessagesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "controly",
+		Name:      "dropped_messages_total",
+		Help:      "Messages dropped because a client's send channel was full, by client type.",
+	}, []string{"client_type"})
+
+	rejectedOriginsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "controly",
+		Name:      "rejected_origins_total",
+		Help:      "Requests rejected because their Origin is not allowed, by client type or \"api\".",
+	}, []string{"client_type"})
+
+	rateLimitedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "controly",
+		Name:      "rate_limited_total",
+		Help:      "Messages dropped and connections refused over a limit, by client type and limit.",
+	}, []string{"client_type", "limit"})
+
+	rateLimitDisconnectsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "controly",
+		Name:      "rate_limit_disconnects_total",
+		Help:      "Clients disconnected for exceeding their rate limits, by client type.",
+	}, []string{"client_type"})
+
+	fanoutSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "controly",
+		Name:      "fanout_size",
+		Help:      "Number of recipients of each delivered message.",
+		Buckets:   []float64{0, 1, 2, 5, 10, 20, 50, 100, 200, 500},
+	})
+
+	commandFetchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "controly",
+		Name:      "command_fetch_duration_seconds",
+		Help:      "Time taken to fetch a display's command_url, by result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"result"})
+)
+
+const (
+	directionIn  = "in"
+	directionOut = "out"
+)
+
+// knownMessageTypes bounds the values of the type label, since clients choose
+// the types of the messages they send.
+var knownMessageTypes = map[string]bool{
+	"set_id":               true,
+	"command_list":         true,
+	"command":              true,
+	"command_result":       true,
+	"status":               true,
+	"status_patch":         true,
+	"subscribe":            true,
+	"unsubscribe":          true,
+	"waiting":              true,
+	"subscribed":           true,
+	"unsubscribed":         true,
+	"display_disconnected": true,
+	"server_shutdown":      true,
+	"error":                true,
+}
+
+func countMessage(msgType, direction string) {
+	if !knownMessageTypes[msgType] {
+		msgType = "unknown"
+	}
+	messagesTotal.WithLabelValues(msgType, direction).Inc()
+}
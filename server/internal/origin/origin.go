@@ -0,0 +1,101 @@
+// Package origin matches the Origin header of browser requests against an
+// allowlist.
+package origin
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Allowlist holds allowed origins. An entry is an exact origin such as
+// "https://example.com", an origin with one wildcard such as
+// "https://*.example.com" or "http://localhost:*", or "*" for any origin.
+type Allowlist struct {
+	any       bool
+	exact     map[string]bool
+	wildcards []wildcard
+}
+
+// wildcard matches origins that start with prefix and end with suffix, with
+// a non-empty run of host name characters between them.
+type wildcard struct {
+	prefix, suffix string
+}
+
+// New compiles patterns into an Allowlist.
+func New(patterns []string) (*Allowlist, error) {
+	a := &Allowlist{exact: make(map[string]bool)}
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSuffix(p, "/"))
+		if p == "*" {
+			a.any = true
+			continue
+		}
+		if err := validate(p); err != nil {
+			return nil, err
+		}
+		if prefix, suffix, ok := strings.Cut(p, "*"); ok {
+			a.wildcards = append(a.wildcards, wildcard{prefix, suffix})
+		} else {
+			a.exact[p] = true
+		}
+	}
+	return a, nil
+}
+
+// validate checks that p is a scheme and host with an optional port and at
+// most one wildcard.
+func validate(p string) error {
+	if strings.Count(p, "*") > 1 {
+		return fmt.Errorf("origin %q has more than one wildcard", p)
+	}
+	u, err := url.Parse(strings.Replace(p, "*", "0", 1))
+	if err != nil || u.Scheme == "" || u.Host == "" || u.User != nil || u.Path != "" || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("origin %q must be scheme://host[:port]", p)
+	}
+	return nil
+}
+
+// Empty reports whether the list allows no origin at all.
+func (a *Allowlist) Empty() bool {
+	return !a.any && len(a.exact) == 0 && len(a.wildcards) == 0
+}
+
+// Allows reports whether origin is on the list.
+func (a *Allowlist) Allows(origin string) bool {
+	if a.any {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if a.exact[origin] {
+		return true
+	}
+	for _, w := range a.wildcards {
+		if len(origin) > len(w.prefix)+len(w.suffix) && strings.HasPrefix(origin, w.prefix) && strings.HasSuffix(origin, w.suffix) {
+			if isHostRun(origin[len(w.prefix) : len(origin)-len(w.suffix)]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isHostRun reports whether s only holds letters, digits, '-' and '.', so a
+// wildcard matches labels of a host name or a port, but never a ':' or '@'
+// that would move it into another part of the origin.
+func isHostRun(s string) bool {
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// SameHost reports whether origin names host, the Host of the request it was
+// sent with, as browsers do for same-origin requests.
+func SameHost(origin, host string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, host)
+}
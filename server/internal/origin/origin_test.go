@@ -0,0 +1,88 @@
+package origin
+
+import "testing"
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		pattern string
+		wantErr bool
+	}{
+		{"https://example.com", false},
+		{"https://example.com/", false},
+		{"https://*.example.com", false},
+		{"http://localhost:*", false},
+		{"*", false},
+		{"example.com", true},
+		{"https://", true},
+		{"https://example.com/path", true},
+		{"https://example.com?q=1", true},
+		{"https://user@example.com", true},
+		{"https://*.*.example.com", true},
+	}
+	for _, tt := range tests {
+		if _, err := New([]string{tt.pattern}); (err != nil) != tt.wantErr {
+			t.Errorf("New(%q) error = %v, wantErr %v", tt.pattern, err, tt.wantErr)
+		}
+	}
+}
+
+func TestAllows(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		origin   string
+		want     bool
+	}{
+		{nil, "https://example.com", false},
+		{[]string{"*"}, "https://anything.test", true},
+
+		{[]string{"https://example.com"}, "https://example.com", true},
+		{[]string{"https://example.com/"}, "https://example.com", true},
+		{[]string{"https://Example.com"}, "HTTPS://EXAMPLE.COM", true},
+		{[]string{"https://example.com"}, "http://example.com", false},
+		{[]string{"https://example.com"}, "https://example.com:8443", false},
+		{[]string{"https://example.com"}, "https://example.com.evil.test", false},
+
+		{[]string{"https://*.example.com"}, "https://a.example.com", true},
+		{[]string{"https://*.example.com"}, "https://a.b.example.com", true},
+		{[]string{"https://*.example.com"}, "https://example.com", false},
+		{[]string{"https://*.example.com"}, "https://.example.com", false},
+		{[]string{"https://*.example.com"}, "https://evil.test/.example.com", false},
+		{[]string{"https://*.example.com"}, "https://evil.test:1@x.example.com", false},
+		{[]string{"https://*.example.com"}, "https://evilexample.com", false},
+
+		{[]string{"http://localhost:*"}, "http://localhost:3000", true},
+		{[]string{"http://localhost:*"}, "http://localhost", false},
+		{[]string{"http://localhost:*"}, "http://localhost:3000:4000", false},
+		{[]string{"http://localhost:*"}, "http://localhost:x@evil.test", false},
+
+		{[]string{"https://a.test", "https://*.b.test"}, "https://x.b.test", true},
+		{[]string{"https://a.test", "https://*.b.test"}, "https://c.test", false},
+	}
+	for _, tt := range tests {
+		a, err := New(tt.patterns)
+		if err != nil {
+			t.Fatalf("New(%q): %v", tt.patterns, err)
+		}
+		if got := a.Allows(tt.origin); got != tt.want {
+			t.Errorf("New(%q).Allows(%q) = %v, want %v", tt.patterns, tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestSameHost(t *testing.T) {
+	tests := []struct {
+		origin, host string
+		want         bool
+	}{
+		{"https://example.com", "example.com", true},
+		{"https://Example.com:8443", "example.com:8443", true},
+		{"https://example.com", "example.com:8443", false},
+		{"https://other.test", "example.com", false},
+		{"null", "example.com", false},
+	}
+	for _, tt := range tests {
+		if got := SameHost(tt.origin, tt.host); got != tt.want {
+			t.Errorf("SameHost(%q, %q) = %v, want %v", tt.origin, tt.host, got, tt.want)
+		}
+	}
+}
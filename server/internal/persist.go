@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/simbafs/controly/server/internal/domain"
+	"github.com/simbafs/controly/server/internal/store"
+)
+
+// persistInterval is how often changed displays and controllers are written
+// to the store. Writes are batched so that frequent status updates do not
+// each hit the disk.
+const persistInterval = 200 * time.Millisecond
+
+// UseStore restores the sessions saved in s and keeps s up to date from then
+// on. It must be called before clients connect.
+func (h *Hub) UseStore(s store.Store) error {
+	displays, controllers, err := s.Load()
+	if err != nil {
+		return fmt.Errorf("load store: %w", err)
+	}
+	h.store = s
+	h.restore(displays, controllers)
+	go func() {
+		ticker := time.NewTicker(persistInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				h.flushStore()
+			case <-h.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// restore recreates saved sessions as detached, so that their clients can
+// resume them with their resume tokens during the restore grace period.
+func (h *Hub) restore(displays []*store.Display, controllers []*store.Controller) {
+	restoredControllers := make(map[string]bool, len(controllers))
+	for _, rec := range controllers {
+		restoredControllers[rec.ID] = true
+	}
+
+	restoredDisplays := make(map[string]bool, len(displays))
+	for _, rec := range displays {
+		commands, err := domain.ParseCommandList(rec.CommandList)
+		if err != nil {
+			slog.Warn("Not restoring display", "client_id", rec.ID, "client_type", "display", "error", err)
+			h.touchDisplay(rec.ID)
+			continue
+		}
+		display := domain.NewDisplay(rec.ID, rec.CommandList, commands, rec.ResumeToken)
+		display.Status = rec.Status
+		for _, id := range rec.Subscribers {
+			if restoredControllers[id] {
+				display.Subscribers[id] = true
+			}
+		}
+		h.displayEntities.Store(rec.ID, display)
+		restoredDisplays[rec.ID] = true
+
+		id := rec.ID
+		detachSession(&h.detachedDisplays, id, h.restoreGrace, func() {
+			h.removeDisplay(id)
+			slog.Info("Restored display did not reconnect in time and was removed", "client_id", id, "client_type", "display")
+		})
+	}
+
+	for _, rec := range controllers {
+		controller := domain.NewController(rec.ID, rec.ResumeToken)
+		controller.StatusPatches = rec.StatusPatches
+		for _, id := range rec.WaitingFor {
+			controller.WaitingFor[id] = true
+		}
+		for _, id := range rec.Subscriptions {
+			// Subscriptions to displays that were not restored, such as ones
+			// on other nodes, wait for the display to come back.
+			if restoredDisplays[id] {
+				controller.Subscriptions[id] = true
+			} else {
+				controller.WaitingFor[id] = true
+			}
+		}
+		h.controllerEntities.Store(rec.ID, controller)
+
+		id := rec.ID
+		detachSession(&h.detachedControllers, id, h.restoreGrace, func() {
+			h.removeController(id)
+			slog.Info("Restored controller session expired and removed", "client_id", id, "client_type", "controller")
+		})
+	}
+	slog.Info("Restored sessions", "displays", len(restoredDisplays), "controllers", len(controllers))
+}
+
+// touchDisplay marks a display as changed, so that it is saved or, once
+// removed, deleted at the next flush.
+func (h *Hub) touchDisplay(displayID string) {
+	if h.store != nil {
+		h.dirtyDisplays.Store(displayID, struct{}{})
+	}
+}
+
+// touchController marks a controller as changed.
+func (h *Hub) touchController(controllerID string) {
+	if h.store != nil {
+		h.dirtyControllers.Store(controllerID, struct{}{})
+	}
+}
+
+// flushStore writes every changed display and controller to the store in one
+// batch.
+func (h *Hub) flushStore() {
+	var displays []*store.Display
+	var controllers []*store.Controller
+	var deletes store.Deletes
+	h.dirtyDisplays.Range(func(key, value any) bool {
+		h.dirtyDisplays.Delete(key)
+		id := key.(string)
+		if d, ok := h.displayEntities.Load(id); ok {
+			displays = append(displays, displayRecord(d.(*domain.Display)))
+		} else {
+			deletes.Displays = append(deletes.Displays, id)
+		}
+		return true
+	})
+	h.dirtyControllers.Range(func(key, value any) bool {
+		h.dirtyControllers.Delete(key)
+		id := key.(string)
+		if c, ok := h.controllerEntities.Load(id); ok {
+			controllers = append(controllers, controllerRecord(c.(*domain.Controller)))
+		} else {
+			deletes.Controllers = append(deletes.Controllers, id)
+		}
+		return true
+	})
+	if len(displays)+len(controllers)+len(deletes.Displays)+len(deletes.Controllers) == 0 {
+		return
+	}
+	if err := h.store.Save(displays, controllers, deletes); err != nil {
+		slog.Error("Error persisting sessions", "displays", len(displays)+len(deletes.Displays),
+			"controllers", len(controllers)+len(deletes.Controllers), "error", err)
+	}
+}
+
+func displayRecord(display *domain.Display) *store.Display {
+	display.Mu.Lock()
+	defer display.Mu.Unlock()
+	return &store.Display{
+		ID:          display.ID,
+		ResumeToken: display.ResumeToken,
+		CommandList: display.CommandList,
+		Status:      display.Status,
+		Subscribers: keys(display.Subscribers),
+	}
+}
+
+func controllerRecord(controller *domain.Controller) *store.Controller {
+	controller.Mu.Lock()
+	defer controller.Mu.Unlock()
+	return &store.Controller{
+		ID:            controller.ID,
+		ResumeToken:   controller.ResumeToken,
+		Subscriptions: keys(controller.Subscriptions),
+		WaitingFor:    keys(controller.WaitingFor),
+		StatusPatches: controller.StatusPatches,
+	}
+}
+
+func keys(m map[string]bool) []string {
+	ids := make([]string, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	return ids
+}
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/simbafs/controly/server/internal/config"
+	"github.com/simbafs/controly/server/internal/store"
+)
+
+func TestSessionsSurviveRestart(t *testing.T) {
+	commands := commandServer(t)
+	path := filepath.Join(t.TempDir(), "controly.db")
+	cfg := config.Default()
+	cfg.Timeouts.RestoreGrace = 500 * time.Millisecond
+
+	// Run a hub with a subscribed controller, then shut it down.
+	first, err := store.OpenBolt(path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := NewHub(cfg)
+	if err := hub.UseStore(first); err != nil {
+		t.Fatal(err)
+	}
+	srv := serveHub(t, hub)
+	displayURL := wsURL(srv, "/ws?type=display&id=d1&command_url="+commands.URL)
+	display := dialClient(t, displayURL, nil)
+	displayToken := display.expectSetID().ResumeToken
+	controller := dialClient(t, wsURL(srv, "/ws?type=controller&id=c1"), nil)
+	controller.expect("set_id")
+	controller.send(`{"type":"subscribe","payload":{"display_ids":["d1"]}}`)
+	controller.expect("command_list")
+	display.expect("subscribed")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := hub.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next hub restores both sessions as detached.
+	second, err := store.OpenBolt(path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { second.Close() })
+	hub = NewHub(cfg)
+	if err := hub.UseStore(second); err != nil {
+		t.Fatal(err)
+	}
+	if !contains(&hub.detachedDisplays, "d1") || !contains(&hub.detachedControllers, "c1") {
+		t.Fatal("saved sessions were not restored as detached")
+	}
+	srv = serveHub(t, hub)
+
+	// The display resumes with its token and keeps its subscriber.
+	display = dialClient(t, wsURL(srv, "/ws?type=display&id=d1&command_url="+commands.URL+"&resume_token="+displayToken), nil)
+	if !display.expectSetID().Resumed {
+		t.Fatal("display did not resume its restored session")
+	}
+	if got := string(display.expect("subscribed")["payload"]); got != `{"count":1}` {
+		t.Errorf("resumed display got subscribed %s, want a count of 1", got)
+	}
+
+	// The controller does not come back, so its session expires and is
+	// deleted from the store.
+	waitFor(t, "the restored controller to expire", func() bool { return !contains(&hub.controllerEntities, "c1") })
+	waitFor(t, "the controller to be deleted from the store", func() bool {
+		displays, controllers, err := second.Load()
+		return err == nil && len(displays) == 1 && len(controllers) == 0
+	})
+}
@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/simbafs/controly/server/internal/config"
+	"github.com/simbafs/controly/server/internal/domain"
+	"golang.org/x/time/rate"
+)
+
+// Limits a client or connection can exceed, as reported in metrics.
+const (
+	limitMessages         = "messages"
+	limitBytes            = "bytes"
+	limitMaxClients       = "max_clients"
+	limitConnectionsPerIP = "connections_per_ip"
+)
+
+// messageLimiter applies token-bucket limits to the messages a client sends.
+type messageLimiter struct {
+	messages *rate.Limiter // Nil when messages per second are not limited
+	bytes    *rate.Limiter // Nil when bytes per second are not limited
+	strikes  *rate.Limiter // Violations tolerated before the client is disconnected
+}
+
+// newMessageLimiter returns a limiter for a client type's rate limits, or nil
+// if the client type sends no messages that need limiting.
+func (h *Hub) newMessageLimiter(clientType domain.ClientType) *messageLimiter {
+	cfg, ok := h.rateLimits[clientType]
+	if !ok {
+		return nil
+	}
+	l := &messageLimiter{
+		strikes: rate.NewLimiter(rate.Every(time.Second), h.maxViolations),
+	}
+	if cfg.MessagesPerSecond > 0 {
+		l.messages = rate.NewLimiter(rate.Limit(cfg.MessagesPerSecond), cfg.MessageBurst)
+	}
+	if cfg.BytesPerSecond > 0 {
+		l.bytes = rate.NewLimiter(rate.Limit(cfg.BytesPerSecond), cfg.ByteBurst)
+	}
+	return l
+}
+
+// allow takes a message of n bytes from the buckets and returns the limit it
+// exceeds, or "" if it is within the limits.
+func (l *messageLimiter) allow(n int) string {
+	if l.messages != nil && !l.messages.Allow() {
+		return limitMessages
+	}
+	if l.bytes != nil && !l.bytes.AllowN(time.Now(), n) {
+		return limitBytes
+	}
+	return ""
+}
+
+// overLimit drops a message over the client's rate limit and tells the client,
+// or disconnects it if it keeps going. A disconnected client's session ends
+// rather than waiting to be resumed. It reports whether the client may stay
+// connected.
+func (c *Client) overLimit(limit string) bool {
+	rateLimitedTotal.WithLabelValues(c.clientType.String(), limit).Inc()
+	if !c.limiter.strikes.Allow() {
+		c.log.Warn("Disconnecting client that keeps exceeding its rate limit", "limit", limit)
+		rateLimitDisconnectsTotal.WithLabelValues(c.clientType.String()).Inc()
+		c.evicted.Store(true)
+		msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limit exceeded")
+		c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(c.hub.writeWait))
+		return false
+	}
+	c.hub.sendError(c.id, domain.NewError(domain.ErrRateLimited, "rate limit exceeded (%s), message dropped", limit))
+	return true
+}
+
+// connLimiter caps the connections open at once, in total and per IP address.
+type connLimiter struct {
+	maxTotal int // Zero disables the cap
+	maxPerIP int // Zero disables the cap
+
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+func newConnLimiter(cfg config.LimitsConfig) *connLimiter {
+	return &connLimiter{
+		maxTotal: cfg.MaxClients,
+		maxPerIP: cfg.MaxConnectionsPerIP,
+		perIP:    make(map[string]int),
+	}
+}
+
+// acquire takes a connection slot for ip. It returns the limit that is
+// reached, or "" if the slot was taken and must be released.
+func (l *connLimiter) acquire(ip string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		return limitMaxClients
+	}
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		return limitConnectionsPerIP
+	}
+	l.total++
+	l.perIP[ip]++
+	return ""
+}
+
+// release frees a connection slot taken for ip.
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// remoteIP returns the IP address a request came from.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/simbafs/controly/server/internal/config"
+	"github.com/simbafs/controly/server/internal/domain"
+)
+
+func TestConnLimiter(t *testing.T) {
+	l := newConnLimiter(config.LimitsConfig{MaxClients: 3, MaxConnectionsPerIP: 2})
+	steps := []struct {
+		acquire bool // Release otherwise
+		ip      string
+		want    string
+	}{
+		{true, "a", ""},
+		{true, "a", ""},
+		{true, "a", limitConnectionsPerIP},
+		{true, "b", ""},
+		{true, "c", limitMaxClients},
+		{false, "a", ""},
+		{true, "c", ""},
+		{true, "b", limitMaxClients},
+		{false, "b", ""},
+		{false, "c", ""},
+		{true, "a", ""},
+		{true, "a", limitConnectionsPerIP},
+	}
+	for i, s := range steps {
+		if !s.acquire {
+			l.release(s.ip)
+			continue
+		}
+		if got := l.acquire(s.ip); got != s.want {
+			t.Errorf("step %d: acquire(%s) = %q, want %q", i, s.ip, got, s.want)
+		}
+	}
+	if len(l.perIP) != 1 || l.perIP["a"] != 2 || l.total != 2 {
+		t.Errorf("total = %d, perIP = %v after steps", l.total, l.perIP)
+	}
+}
+
+func TestConnLimiterUnlimited(t *testing.T) {
+	l := newConnLimiter(config.LimitsConfig{})
+	for range 100 {
+		if got := l.acquire("a"); got != "" {
+			t.Fatalf("acquire() = %q with no limits", got)
+		}
+	}
+}
+
+func TestMessageLimiter(t *testing.T) {
+	cfg := config.Default()
+	cfg.Limits.MaxViolations = 2
+	cfg.Limits.Display = config.RateConfig{MessagesPerSecond: 1, MessageBurst: 3}
+	cfg.Limits.Controller = config.RateConfig{BytesPerSecond: 1, ByteBurst: 100}
+	h := NewHub(cfg)
+
+	if l := h.newMessageLimiter(domain.ClientTypeInspector); l != nil {
+		t.Error("inspectors have a message limiter")
+	}
+
+	display := h.newMessageLimiter(domain.ClientTypeDisplay)
+	if display.bytes != nil {
+		t.Error("display has a byte limit with a zero byte rate")
+	}
+	for i := range 3 {
+		if got := display.allow(1 << 20); got != "" {
+			t.Fatalf("message %d within the burst: allow() = %q", i, got)
+		}
+	}
+	if got := display.allow(1); got != limitMessages {
+		t.Errorf("message past the burst: allow() = %q, want %q", got, limitMessages)
+	}
+
+	controller := h.newMessageLimiter(domain.ClientTypeController)
+	if controller.messages != nil {
+		t.Error("controller has a message limit with a zero message rate")
+	}
+	if got := controller.allow(60); got != "" {
+		t.Errorf("allow(60) = %q within the byte burst", got)
+	}
+	if got := controller.allow(60); got != limitBytes {
+		t.Errorf("allow(60) = %q past the byte burst, want %q", got, limitBytes)
+	}
+	if got := controller.allow(30); got != "" {
+		t.Errorf("allow(30) = %q with bytes left in the burst", got)
+	}
+
+	for i := range 2 {
+		if !controller.strikes.Allow() {
+			t.Fatalf("violation %d of 2 not tolerated", i+1)
+		}
+	}
+	if controller.strikes.Allow() {
+		t.Error("violation past max_violations tolerated")
+	}
+}
+
+func TestConnectionsPerIPAreLimited(t *testing.T) {
+	commands := commandServer(t)
+	cfg := config.Default()
+	cfg.Limits.MaxConnectionsPerIP = 1
+	srv := serveHub(t, NewHub(cfg))
+
+	display := dialClient(t, wsURL(srv, "/ws?type=display&id=d1&command_url="+commands.URL), nil)
+	display.expect("set_id")
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL(srv, "/ws?type=controller"), nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("second connection from the same IP: err = %v, response = %v, want 429", err, resp)
+	}
+
+	// The slot is freed when the display disconnects.
+	display.conn.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL(srv, "/ws?type=controller"), nil)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) || !strings.Contains(err.Error(), "bad handshake") {
+			t.Fatalf("connection after the display left: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRateLimitDisconnectEndsSession(t *testing.T) {
+	cfg := config.Default()
+	cfg.Limits.MaxViolations = 1
+	cfg.Limits.Controller.MessagesPerSecond = 1
+	cfg.Limits.Controller.MessageBurst = 1
+	hub := NewHub(cfg)
+	srv := serveHub(t, hub)
+
+	controller := dialClient(t, wsURL(srv, "/ws?type=controller&id=c1"), nil)
+	controller.expect("set_id")
+	for range 5 {
+		// Writes may fail once the server has closed the connection.
+		controller.conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"waiting","payload":[]}`))
+	}
+	timeout := time.After(5 * time.Second)
+	for open := true; open; {
+		select {
+		case _, open = <-controller.messages:
+		case <-timeout:
+			t.Fatal("client over its rate limit was not disconnected")
+		}
+	}
+
+	// The session is removed instead of being kept for resuming.
+	waitFor(t, "the session to be removed", func() bool { return !contains(&hub.controllerEntities, "c1") })
+	if contains(&hub.detachedControllers, "c1") {
+		t.Error("session of a client disconnected for its rate limit can be resumed")
+	}
+	controller = dialClient(t, wsURL(srv, "/ws?type=controller&id=c1"), nil)
+	if controller.expectSetID().Resumed {
+		t.Error("reconnect resumed the session of a client disconnected for its rate limit")
+	}
+}
@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/simbafs/controly/server/internal/domain"
+)
+
+// Shutdown stops accepting connections, tells every client that the server is
+// going away and closes their connections with CloseServiceRestart. It waits
+// until all queued messages have been written or ctx expires. Sessions are kept
+// in the store, so clients can resume them once the server is back.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.stopOnce.Do(func() {
+		h.shuttingDown.Store(true)
+		close(h.stop)
+	})
+
+	select {
+	case <-h.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		h.pumps.Wait()
+		close(drained)
+	}()
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+		slog.Warn("Shutdown deadline reached before all connections were drained")
+	}
+
+	if h.store != nil {
+		h.flushStore()
+	}
+	return err
+}
+
+// closeAll sends 'server_shutdown' to every client and closes their connections.
+// It runs on the hub's Run loop, which owns the send channels.
+func (h *Hub) closeAll() {
+	payload, _ := json.Marshal(domain.ServerShutdownPayload{ReconnectAfter: h.reconnectDelay.Milliseconds()})
+	msg, _ := json.Marshal(domain.OutgoingMessage{Type: "server_shutdown", From: "server", Payload: payload})
+
+	count := 0
+	for _, clients := range []*sync.Map{&h.displays, &h.controllers, &h.inspectors} {
+		clients.Range(func(key, value any) bool {
+			client := value.(*Client)
+			if !clients.CompareAndDelete(key, client) {
+				return true
+			}
+			select {
+			case client.send <- msg:
+			default:
+			}
+			client.closeCode = websocket.CloseServiceRestart
+			close(client.send)
+			connectedClients.WithLabelValues(client.clientType.String()).Dec()
+			count++
+			return true
+		})
+	}
+	slog.Info("Closed connections for shutdown", "connections", count)
+}
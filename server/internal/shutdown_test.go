@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/simbafs/controly/server/internal/config"
+	"github.com/simbafs/controly/server/internal/domain"
+	"github.com/simbafs/controly/server/internal/store"
+)
+
+func TestShutdownClosesClientsAndFlushesStore(t *testing.T) {
+	commands := commandServer(t)
+	s, err := store.OpenBolt(filepath.Join(t.TempDir(), "controly.db"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	cfg := config.Default()
+	cfg.Timeouts.ReconnectDelay = 1500 * time.Millisecond
+	hub := NewHub(cfg)
+	if err := hub.UseStore(s); err != nil {
+		t.Fatal(err)
+	}
+	srv := serveHub(t, hub)
+
+	display := dialClient(t, wsURL(srv, "/ws?type=display&id=d1&command_url="+commands.URL), nil)
+	display.expect("set_id")
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL(srv, "/ws?type=controller&id=c1"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"subscribe","payload":{"display_ids":["d1"]}}`))
+	display.expect("subscribed")
+	display.send(`{"type":"status","payload":{"n":1}}`)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg domain.OutgoingMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for status: %v", err)
+		}
+		if msg.Type == "status" {
+			break
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- hub.Shutdown(ctx) }()
+
+	// server_shutdown is the last message before the close frame.
+	var shutdown *domain.ServerShutdownPayload
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if shutdown == nil {
+				t.Fatalf("connection closed before server_shutdown: %v", err)
+			}
+			if !websocket.IsCloseError(err, websocket.CloseServiceRestart) {
+				t.Errorf("connection closed with %v, want close code %d", err, websocket.CloseServiceRestart)
+			}
+			break
+		}
+		var msg domain.OutgoingMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if shutdown != nil {
+			t.Errorf("got %s after server_shutdown", msg.Type)
+		}
+		if msg.Type == "server_shutdown" {
+			shutdown = &domain.ServerShutdownPayload{}
+			json.Unmarshal(msg.Payload, shutdown)
+		}
+	}
+	if shutdown != nil && shutdown.ReconnectAfter != cfg.Timeouts.ReconnectDelay.Milliseconds() {
+		t.Errorf("server_shutdown suggested reconnecting after %dms, want %dms", shutdown.ReconnectAfter, cfg.Timeouts.ReconnectDelay.Milliseconds())
+	}
+	display.expect("server_shutdown")
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	displays, controllers, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(displays) != 1 || string(displays[0].Status) != `{"n":1}` || len(displays[0].Subscribers) != 1 {
+		data, _ := json.Marshal(displays)
+		t.Errorf("store has displays %s, want d1 with its status and subscriber", data)
+	}
+	if len(controllers) != 1 || len(controllers[0].Subscriptions) != 1 {
+		data, _ := json.Marshal(controllers)
+		t.Errorf("store has controllers %s, want c1 with its subscription", data)
+	}
+}
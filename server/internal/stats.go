@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// connStats counts the traffic of a single WebSocket connection. Payload bytes
+// are counted before compression and wire bytes as they go over the network,
+// so their ratio is the compression ratio achieved.
+type connStats struct {
+	compression          bool // Whether permessage-deflate was negotiated
+	compressionThreshold int  // Size in bytes below which messages are sent uncompressed
+
+	messagesSent      atomic.Uint64
+	bytesSent         atomic.Uint64
+	wireBytesSent     atomic.Uint64
+	messagesReceived  atomic.Uint64
+	bytesReceived     atomic.Uint64
+	wireBytesReceived atomic.Uint64
+}
+
+// ConnStatsSnapshot is the JSON representation of a connection's stats.
+type ConnStatsSnapshot struct {
+	ID                   string  `json:"id"`
+	Type                 string  `json:"type"`
+	Compression          bool    `json:"compression"`
+	CompressionThreshold int     `json:"compression_threshold"` // Size in bytes below which messages are sent uncompressed
+	MessagesSent         uint64  `json:"messages_sent"`
+	BytesSent            uint64  `json:"bytes_sent"`
+	WireBytesSent        uint64  `json:"wire_bytes_sent"`
+	MessagesReceived     uint64  `json:"messages_received"`
+	BytesReceived        uint64  `json:"bytes_received"`
+	WireBytesReceived    uint64  `json:"wire_bytes_received"`
+	CompressionRatio     float64 `json:"compression_ratio"` // wire_bytes_sent / bytes_sent, 0 before anything was sent
+}
+
+func (s *connStats) snapshot(client *Client) ConnStatsSnapshot {
+	snap := ConnStatsSnapshot{
+		ID:                   client.id,
+		Type:                 client.clientType.String(),
+		Compression:          s.compression,
+		CompressionThreshold: s.compressionThreshold,
+		MessagesSent:         s.messagesSent.Load(),
+		BytesSent:            s.bytesSent.Load(),
+		WireBytesSent:        s.wireBytesSent.Load(),
+		MessagesReceived:     s.messagesReceived.Load(),
+		BytesReceived:        s.bytesReceived.Load(),
+		WireBytesReceived:    s.wireBytesReceived.Load(),
+	}
+	if snap.BytesSent > 0 {
+		snap.CompressionRatio = float64(snap.WireBytesSent) / float64(snap.BytesSent)
+	}
+	return snap
+}
+
+// countingConn counts the bytes read from and written to a network connection.
+type countingConn struct {
+	net.Conn
+	stats   *connStats
+	onClose func() // Called on every Close, so it must be idempotent
+}
+
+func (c *countingConn) Close() error {
+	if c.onClose != nil {
+		c.onClose()
+	}
+	return c.Conn.Close()
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.stats.wireBytesReceived.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.stats.wireBytesSent.Add(uint64(n))
+	return n, err
+}
+
+// statsResponseWriter hands a countingConn to the WebSocket upgrader when it
+// hijacks the connection.
+type statsResponseWriter struct {
+	http.ResponseWriter
+	stats   *connStats
+	onClose func()
+}
+
+func (w *statsResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &countingConn{Conn: conn, stats: w.stats, onClose: w.onClose}, brw, nil
+}
+
+// offersDeflate reports whether the client offered the permessage-deflate extension.
+func offersDeflate(r *http.Request) bool {
+	for _, ext := range r.Header.Values("Sec-WebSocket-Extensions") {
+		if strings.Contains(ext, "permessage-deflate") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/simbafs/controly/server/internal/config"
+	"github.com/simbafs/controly/server/internal/domain"
+)
+
+// connStatsOf returns the stats StatsHandler reports for a connection.
+func connStatsOf(t *testing.T, hub *Hub, id string) ConnStatsSnapshot {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	hub.StatsHandler(rec, httptest.NewRequest("GET", "/api/stats", nil))
+	var stats []ConnStatsSnapshot
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range stats {
+		if s.ID == id {
+			return s
+		}
+	}
+	t.Fatalf("no stats for %s", id)
+	return ConnStatsSnapshot{}
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	commands := commandServer(t)
+	cfg := config.Default()
+	cfg.Compression.Enabled = true
+	cfg.Compression.Threshold = 512
+	cfg.Limits.MaxMessageSize = 4096
+	hub := NewHub(cfg)
+	srv := serveHub(t, hub)
+
+	display := dialClient(t, wsURL(srv, "/ws?type=display&id=d1&command_url="+commands.URL), nil)
+	display.expect("set_id")
+	dialer := websocket.Dialer{EnableCompression: true}
+	controllers := map[string]*testClient{}
+	for id, query := range map[string]string{"default": "", "eager": "&compression_threshold=0"} {
+		conn, _, err := dialer.Dial(wsURL(srv, "/ws?type=controller&id="+id+query), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		controllers[id] = newTestClient(t, conn)
+		controllers[id].expect("set_id")
+		controllers[id].send(`{"type":"subscribe","payload":{"display_ids":["d1"]}}`)
+		controllers[id].expect("command_list")
+	}
+	if got := connStatsOf(t, hub, "default").CompressionThreshold; got != 512 {
+		t.Errorf("default threshold is %d, want 512", got)
+	}
+	if got := connStatsOf(t, hub, "eager").CompressionThreshold; got != 0 {
+		t.Errorf("overridden threshold is %d, want 0", got)
+	}
+
+	// sendStatus sends a status and returns the size of the message and the
+	// wire bytes each controller received it in.
+	sendStatus := func(payload string) (int, map[string]uint64) {
+		t.Helper()
+		before := map[string]uint64{}
+		for id := range controllers {
+			before[id] = connStatsOf(t, hub, id).WireBytesSent
+		}
+		display.send(`{"type":"status","payload":` + payload + `}`)
+		wire := map[string]uint64{}
+		for id, c := range controllers {
+			c.expect("status")
+			wire[id] = connStatsOf(t, hub, id).WireBytesSent - before[id]
+		}
+		msg, _ := json.Marshal(domain.OutgoingMessage{Type: "status", From: "d1", Payload: json.RawMessage(payload)})
+		return len(msg), wire
+	}
+
+	size, wire := sendStatus(`{"text":"` + strings.Repeat("a", 100) + `"}`)
+	if wire["default"] < uint64(size) {
+		t.Errorf("%d byte message below the threshold took %d wire bytes, want it uncompressed", size, wire["default"])
+	}
+	if wire["eager"] >= uint64(size) {
+		t.Errorf("%d byte message took %d wire bytes with a threshold of 0, want it compressed", size, wire["eager"])
+	}
+
+	size, wire = sendStatus(`{"text":"` + strings.Repeat("a", 2000) + `"}`)
+	for id, n := range wire {
+		if n >= uint64(size)/2 {
+			t.Errorf("%d byte message took %d wire bytes for %s, want it compressed", size, n, id)
+		}
+	}
+
+	stats := connStatsOf(t, hub, "default")
+	if !stats.Compression || stats.MessagesSent < 4 || stats.BytesSent <= stats.WireBytesSent ||
+		stats.CompressionRatio <= 0 || stats.CompressionRatio >= 1 || stats.MessagesReceived != 1 || stats.WireBytesReceived == 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestInvalidCompressionThresholdIsRejected(t *testing.T) {
+	srv := serveHub(t, NewHub(config.Default()))
+	for _, threshold := range []string{"-1", "big"} {
+		dialClient(t, wsURL(srv, "/ws?type=controller&compression_threshold="+threshold), nil).expectError(domain.ErrInvalidQueryParams)
+	}
+}
@@ -0,0 +1,107 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	displaysBucket    = []byte("displays")
+	controllersBucket = []byte("controllers")
+)
+
+// BoltStore is a Store backed by a bbolt database file.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBolt opens or creates the database at path. If another process has it
+// open, OpenBolt waits up to timeout for it to be released.
+func OpenBolt(path string, timeout time.Duration) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: timeout})
+	if err != nil {
+		return nil, fmt.Errorf("open store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{displaysBucket, controllersBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("initialize store %s: %w", path, err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Load() ([]*Display, []*Controller, error) {
+	var displays []*Display
+	var controllers []*Controller
+	err := s.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(displaysBucket).ForEach(func(k, v []byte) error {
+			var d Display
+			if err := json.Unmarshal(v, &d); err != nil {
+				return fmt.Errorf("display %s: %w", k, err)
+			}
+			displays = append(displays, &d)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(controllersBucket).ForEach(func(k, v []byte) error {
+			var c Controller
+			if err := json.Unmarshal(v, &c); err != nil {
+				return fmt.Errorf("controller %s: %w", k, err)
+			}
+			controllers = append(controllers, &c)
+			return nil
+		})
+	})
+	return displays, controllers, err
+}
+
+// Save writes the whole batch in a single transaction.
+func (s *BoltStore) Save(displays []*Display, controllers []*Controller, deletes Deletes) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, d := range displays {
+			if err := put(tx.Bucket(displaysBucket), d.ID, d); err != nil {
+				return fmt.Errorf("display %s: %w", d.ID, err)
+			}
+		}
+		for _, c := range controllers {
+			if err := put(tx.Bucket(controllersBucket), c.ID, c); err != nil {
+				return fmt.Errorf("controller %s: %w", c.ID, err)
+			}
+		}
+		for _, id := range deletes.Displays {
+			if err := tx.Bucket(displaysBucket).Delete([]byte(id)); err != nil {
+				return fmt.Errorf("display %s: %w", id, err)
+			}
+		}
+		for _, id := range deletes.Controllers {
+			if err := tx.Bucket(controllersBucket).Delete([]byte(id)); err != nil {
+				return fmt.Errorf("controller %s: %w", id, err)
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func put(bucket *bolt.Bucket, key string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), data)
+}
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T, path string) *BoltStore {
+	t.Helper()
+	s, err := OpenBolt(path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestBoltStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "controly.db")
+	display := &Display{
+		ID:          "d1",
+		ResumeToken: "dt",
+		CommandList: json.RawMessage(`[{"name":"next","type":"button"}]`),
+		Status:      json.RawMessage(`{"n":1}`),
+		Subscribers: []string{"c1"},
+	}
+	controller := &Controller{
+		ID:            "c1",
+		ResumeToken:   "ct",
+		Subscriptions: []string{"d1"},
+		WaitingFor:    []string{"d2"},
+		StatusPatches: true,
+	}
+
+	s := openTestStore(t, path)
+	err := s.Save(
+		[]*Display{display, {ID: "d2", CommandList: json.RawMessage(`[]`)}},
+		[]*Controller{controller, {ID: "c2"}},
+		Deletes{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(nil, nil, Deletes{Displays: []string{"d2"}, Controllers: []string{"c2", "unknown"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestStore(t, path)
+	defer s.Close()
+	displays, controllers, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(displays) != 1 || !reflect.DeepEqual(displays[0], display) {
+		t.Errorf("loaded displays %+v, want only %+v", displays, display)
+	}
+	if len(controllers) != 1 || !reflect.DeepEqual(controllers[0], controller) {
+		t.Errorf("loaded controllers %+v, want only %+v", controllers, controller)
+	}
+}
@@ -0,0 +1,39 @@
+// Package store keeps the hub's sessions on disk so that displays and
+// controllers can pick up where they left off after a restart.
+package store
+
+import "encoding/json"
+
+// Display is the durable state of a display.
+type Display struct {
+	ID          string          `json:"id"`
+	ResumeToken string          `json:"resume_token"`
+	CommandList json.RawMessage `json:"command_list"`
+	Status      json.RawMessage `json:"status,omitempty"`
+	Subscribers []string        `json:"subscribers,omitempty"`
+}
+
+// Controller is the durable state of a controller session.
+type Controller struct {
+	ID            string   `json:"id"`
+	ResumeToken   string   `json:"resume_token"`
+	Subscriptions []string `json:"subscriptions,omitempty"`
+	WaitingFor    []string `json:"waiting_for,omitempty"`
+	StatusPatches bool     `json:"status_patches,omitempty"`
+}
+
+// Deletes names the displays and controllers to remove from a store.
+type Deletes struct {
+	Displays    []string
+	Controllers []string
+}
+
+// Store persists displays and controller sessions.
+type Store interface {
+	// Load returns everything that has been saved.
+	Load() ([]*Display, []*Controller, error)
+	// Save writes displays and controllers, replacing earlier versions, and
+	// removes deletes, all at once.
+	Save(displays []*Display, controllers []*Controller, deletes Deletes) error
+	Close() error
+}
@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"context"
+
+	"github.com/simbafs/controly/server/internal/domain"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/simbafs/controly/server")
+
+// traceContext returns a context that continues the trace in a message's
+// trace field, if any.
+func traceContext(tc domain.TraceContext) context.Context {
+	return otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(tc))
+}
+
+// traceFields returns the trace field for messages sent on behalf of the span
+// in ctx, or nil if there is no trace.
+func traceFields(ctx context.Context) domain.TraceContext {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return nil
+	}
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return domain.TraceContext(carrier)
+}
+
+// recordError marks a span as failed.
+func recordError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
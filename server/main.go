@@ -1,40 +1,155 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"embed"
+	"errors"
+	"flag"
+	"fmt"
 	"io/fs"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/simbafs/controly/server/internal"
+	"github.com/simbafs/controly/server/internal/certs"
 	"github.com/simbafs/controly/server/internal/config"
+	"github.com/simbafs/controly/server/internal/federation"
+	"github.com/simbafs/controly/server/internal/jwtauth"
+	"github.com/simbafs/controly/server/internal/logging"
+	"github.com/simbafs/controly/server/internal/origin"
+	"github.com/simbafs/controly/server/internal/store"
+	"github.com/simbafs/controly/server/internal/tracing"
 )
 
 //go:embed all:controller/*
 var files embed.FS
 
 func main() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	cfg, printConfig, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if printConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err := logging.Setup(cfg.Log.Level, cfg.Log.Format); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
 	var rLimit syscall.Rlimit
 	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rLimit); err != nil {
-		log.Println("Warning: could not get file descriptor limit:", err)
+		slog.Warn("Could not get file descriptor limit", "error", err)
 	} else {
 		rLimit.Cur = rLimit.Max
 		if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rLimit); err != nil {
-			log.Println("Warning: could not set file descriptor limit:", err)
+			slog.Warn("Could not set file descriptor limit", "error", err)
 		} else {
-			log.Printf("File descriptor limit set to: %d", rLimit.Cur)
+			slog.Info("File descriptor limit set", "limit", rLimit.Cur)
+		}
+	}
+
+	slog.Info("Starting", "pid", os.Getpid())
+	cfg.LogSummary()
+
+	addrs := []string{cfg.Addr}
+	if cfg.TLS.RedirectAddr != "" {
+		addrs = append(addrs, cfg.TLS.RedirectAddr)
+	}
+	if cfg.Admin.Addr != "" {
+		addrs = append(addrs, cfg.Admin.Addr)
+	}
+	lns, inherited, err := listen(addrs...)
+	if err != nil {
+		fatal(err)
+	}
+	ln := lns[0]
+	var redirectLn, adminLn net.Listener
+	next := 1
+	if cfg.TLS.RedirectAddr != "" {
+		redirectLn = lns[next]
+		next++
+	}
+	if cfg.Admin.Addr != "" {
+		adminLn = lns[next]
+	}
+	if inherited {
+		slog.Info("Took over listener from the previous process", "addr", ln.Addr().String())
+	}
+
+	var reloader *certs.Reloader
+	if cfg.TLS.CertFile != "" {
+		reloader, err = certs.NewReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			fatal(err)
 		}
+		go reloader.Watch(certPollInterval, nil)
 	}
 
-	log.Printf("PID: %d", os.Getpid())
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Trace.Exporter, cfg.Trace.File)
+	if err != nil {
+		fatal(err)
+	}
+	if cfg.Trace.Exporter != "" {
+		slog.Info("Tracing is enabled", "exporter", cfg.Trace.Exporter)
+	}
 
-	cfg := config.NewConfig()
-	hub := internal.NewHub(cfg.Token)
+	hub := internal.NewHub(cfg)
+	var broker *federation.PeerBroker
+	if len(cfg.Federation.Peers) > 0 {
+		broker = federation.NewPeerBroker(cfg.Federation.NodeID, cfg.Federation.Peers, cfg.Federation.Secret)
+		if cfg.Federation.CAFile != "" || cfg.Federation.CertFile != "" {
+			tlsConfig, err := federationTLS(cfg.Federation)
+			if err != nil {
+				fatal(err)
+			}
+			broker.UseTLS(tlsConfig)
+		}
+		hub.UseBroker(broker)
+	}
+	var sessionStore *store.BoltStore
+	if cfg.Store.Path != "" {
+		// After a handoff, the previous process holds the database until it
+		// has drained and saved its sessions. Connections to the inherited
+		// listener wait in its backlog until then, as nothing accepts them
+		// before the sessions are restored.
+		lockTimeout := time.Second
+		if inherited {
+			lockTimeout = cfg.Timeouts.Shutdown + 5*time.Second
+			slog.Info("Waiting for the previous process to release the store", "path", cfg.Store.Path, "timeout", lockTimeout)
+		}
+		sessionStore, err = store.OpenBolt(cfg.Store.Path, lockTimeout)
+		if err != nil {
+			fatal(err)
+		}
+		if err := hub.UseStore(sessionStore); err != nil {
+			fatal(err)
+		}
+		slog.Info("Sessions are persisted", "path", cfg.Store.Path)
+	}
+	if cfg.Auth.JWTSecret != "" || cfg.Auth.JWTPublicKey != "" {
+		verifier, err := jwtauth.NewVerifier(cfg.Auth.JWTSecret, cfg.Auth.JWTPublicKey)
+		if err != nil {
+			fatal(err)
+		}
+		hub.UseJWT(verifier)
+	}
 	go hub.Run()
 
 	contentFs, err := fs.Sub(files, "controller/dist")
@@ -44,18 +159,177 @@ func main() {
 
 	router := mux.NewRouter()
 
+	// The REST API, the inspector, federation links and metrics are admin
+	// routes, served on their own address if one is set.
+	adminRouter := router
+	if adminLn != nil {
+		adminRouter = mux.NewRouter()
+	}
+	requireAdmin := func(next http.Handler) http.Handler { return next }
+	if len(cfg.Admin.APIKeys) > 0 {
+		requireAdmin = internal.AdminAuth(cfg.Admin.APIKeys)
+	}
+
 	// WebSocket handlers
 	router.HandleFunc("/ws", hub.ServeWs)
-	router.HandleFunc("/ws/inspector", hub.InspectorWsHandler)
+	adminRouter.Handle("/ws/inspector", requireAdmin(http.HandlerFunc(hub.InspectorWsHandler)))
+
+	// Links from other relay nodes
+	if broker != nil {
+		adminRouter.Handle("/federation", broker)
+		broker.Start(hub)
+	}
+
+	adminRouter.Handle("/metrics", promhttp.Handler()).Methods("GET")
 
 	// REST API handlers
-	router.HandleFunc("/api/connections", hub.ConnectionsHandler).Methods("GET")
-	router.HandleFunc("/api/displays/{id}", hub.DeleteDisplayHandler).Methods("DELETE")
-	router.HandleFunc("/api/controllers/{id}", hub.DeleteControllerHandler).Methods("DELETE")
+	apiOrigins, err := origin.New(cfg.Origins.ForClient("api"))
+	if err != nil {
+		fatal(err)
+	}
+	api := adminRouter.PathPrefix("/api").Subrouter()
+	// CORS comes first, as preflight requests carry no API key.
+	api.Use(internal.CORS(apiOrigins), requireAdmin)
+	api.HandleFunc("/connections", hub.ConnectionsHandler).Methods("GET", "OPTIONS")
+	api.HandleFunc("/stats", hub.StatsHandler).Methods("GET", "OPTIONS")
+	api.HandleFunc("/displays/{id}/status", hub.DisplayStatusHandler).Methods("GET", "OPTIONS")
+	api.HandleFunc("/displays/{id}", hub.DeleteDisplayHandler).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/controllers/{id}", hub.DeleteControllerHandler).Methods("DELETE", "OPTIONS")
 
-	// Serve embedded frontend files
+	// Serve embedded frontend files, also on the admin address for the
+	// inspector page.
 	router.PathPrefix("/").Handler(hub.FrontendHandler(contentFs))
+	if adminRouter != router {
+		adminRouter.PathPrefix("/").Handler(hub.FrontendHandler(contentFs))
+	}
+
+	srv := &http.Server{Handler: router}
+	if reloader != nil {
+		srv.TLSConfig = &tls.Config{GetCertificate: reloader.GetCertificate}
+		if cfg.TLS.ClientCA != "" {
+			srv.TLSConfig.ClientCAs, err = certs.LoadPool(cfg.TLS.ClientCA)
+			if err != nil {
+				fatal(err)
+			}
+			srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			if cfg.TLS.ClientAuth == "require" {
+				srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+		}
+	}
+	go func() {
+		slog.Info("Relay Server started", "addr", ln.Addr().String(), "tls", reloader != nil)
+		var err error
+		if reloader != nil {
+			err = srv.ServeTLS(ln, "", "")
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			fatal(err)
+		}
+	}()
+
+	var redirectSrv *http.Server
+	if redirectLn != nil {
+		redirectSrv = &http.Server{Handler: redirectToHTTPS(ln.Addr())}
+		go func() {
+			slog.Info("Redirecting HTTP to HTTPS", "addr", redirectLn.Addr().String())
+			if err := redirectSrv.Serve(redirectLn); err != nil && err != http.ErrServerClosed {
+				fatal(err)
+			}
+		}()
+	}
+
+	// The admin server shares the certificate of the public one, so API keys
+	// are not sent in the clear, but never requires a client certificate:
+	// API clients, metrics scrapers and peers authenticate otherwise.
+	var adminSrv *http.Server
+	if adminLn != nil {
+		adminSrv = &http.Server{Handler: adminRouter}
+		if reloader != nil {
+			adminSrv.TLSConfig = &tls.Config{GetCertificate: reloader.GetCertificate}
+		}
+		go func() {
+			slog.Info("Admin server started", "addr", adminLn.Addr().String(), "tls", reloader != nil)
+			var err error
+			if reloader != nil {
+				err = adminSrv.ServeTLS(adminLn, "", "")
+			} else {
+				err = adminSrv.Serve(adminLn)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				fatal(err)
+			}
+		}()
+	}
+
+	// SIGUSR2 restarts the server without closing the listening socket: a new
+	// process takes it over and this one shuts down. Clients reconnect to the
+	// new process and resume their sessions, which only reach it through the
+	// store. SIGHUP reloads the TLS certificate.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2, syscall.SIGHUP)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			if reloader == nil {
+				continue
+			}
+			if err := reloader.Reload(); err != nil {
+				slog.Error("Could not reload TLS certificate, keeping the current one", "error", err)
+			} else {
+				slog.Info("Reloaded TLS certificate", "cert_file", cfg.TLS.CertFile)
+			}
+			continue
+		}
+		if sig != syscall.SIGUSR2 {
+			slog.Info("Shutting down", "signal", sig.String())
+			break
+		}
+		if sessionStore == nil {
+			slog.Warn("Restarting without store.path, so sessions are lost and clients reconnect as new ones")
+		}
+		child, err := startChild(lns...)
+		if err != nil {
+			slog.Error("Restart failed, keeping this process", "error", err)
+			continue
+		}
+		slog.Info("Started new process, shutting down", "pid", child.Pid)
+		break
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Shutdown)
+	defer cancel()
+	// Stop accepting connections before draining the hub. After a handoff the
+	// new process then gets every new connection, including the clients that
+	// reconnect from this one. Shutting down the HTTP servers leaves upgraded
+	// WebSocket connections open for the hub to drain.
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("HTTP server shutdown", "error", err)
+	}
+	if redirectSrv != nil {
+		redirectSrv.Shutdown(ctx)
+	}
+	if adminSrv != nil {
+		adminSrv.Shutdown(ctx)
+	}
+	if err := hub.Shutdown(ctx); err != nil {
+		slog.Error("Hub shutdown", "error", err)
+	}
+	if sessionStore != nil {
+		sessionStore.Close()
+	}
+	if broker != nil {
+		broker.Close()
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("Tracing shutdown", "error", err)
+	}
+	slog.Info("Server stopped")
+}
 
-	log.Printf("Relay Server started on %s", cfg.Addr)
-	log.Fatal(http.ListenAndServe(cfg.Addr, router))
+// fatal logs an error and exits.
+func fatal(err error) {
+	slog.Error(err.Error())
+	os.Exit(1)
 }
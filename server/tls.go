@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/simbafs/controly/server/internal/certs"
+	"github.com/simbafs/controly/server/internal/config"
+)
+
+// certPollInterval is how often the TLS certificate files are checked for changes.
+const certPollInterval = 5 * time.Second
+
+// federationTLS returns the TLS configuration links to federation peers are
+// dialled with. A client certificate is reloaded when its files change.
+func federationTLS(cfg config.FederationConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if cfg.CAFile != "" {
+		pool, err := certs.LoadPool(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.CertFile != "" {
+		reloader, err := certs.NewReloader(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		go reloader.Watch(certPollInterval, nil)
+		tlsConfig.GetClientCertificate = reloader.GetClientCertificate
+	}
+	return tlsConfig, nil
+}
+
+// redirectToHTTPS redirects requests to the same URL on the HTTPS listener at addr.
+func redirectToHTTPS(addr net.Addr) http.Handler {
+	_, port, _ := net.SplitHostPort(addr.String())
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]") // No port
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		target := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+		// 308 keeps the method, so API calls are redirected too.
+		http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+	})
+}